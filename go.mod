@@ -3,6 +3,6 @@ module technology
 go 1.14
 
 require (
-	github.com/google/uuid v1.1.1 // indirect
+	github.com/google/uuid v1.1.1
 	github.com/sirupsen/logrus v1.6.0
 )
@@ -2,15 +2,48 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"technology/message-oriented-middleware/comm"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// 队列已满时的处理策略
+const (
+	OverflowReject     = "reject"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowBlock      = "block"
+)
+
+// exchange 的类型与 headers 类型绑定的匹配方式
+const (
+	ExchangeDirect  = "direct"
+	ExchangeFanout  = "fanout"
+	ExchangeTopic   = "topic"
+	ExchangeHeaders = "headers"
+	MatchAll        = "all"
+	MatchAny        = "any"
+)
+
+// stream 的 seek 位置
+const (
+	SeekBeginning = "beginning"
+	SeekEnd       = "end"
+	SeekTimestamp = "timestamp"
+)
+
+const (
+	// defaultCallTimeout ctx 没有截止时间时 Call 等待响应的最长时间
+	defaultCallTimeout = 30 * time.Second
+)
+
 type Client struct {
 	schema     string
 	addr       string
@@ -18,103 +51,419 @@ type Client struct {
 }
 
 func NewClient(addr string) *Client {
+	return NewClientWithTransport(addr, comm.DefaultReliableTransport)
+}
+
+// NewUnixClient 通过 unix domain socket 连接 broker
+func NewUnixClient(socketPath string) *Client {
+	return NewClientWithTransport("unix", comm.NewReliableUnixTransport(socketPath))
+}
+
+// NewPipeClient 通过进程内的 PipeListener 连接 broker
+func NewPipeClient(pl *comm.PipeListener) *Client {
+	return NewClientWithTransport(pl.Addr().String(), comm.NewReliablePipeTransport(pl))
+}
+
+// NewClientWithTransport 使用指定的 transport 构造客户端，addr 仅用于构造请求 url
+func NewClientWithTransport(addr string, transport http.RoundTripper) *Client {
 	return &Client{
 		schema: "http",
 		addr:   addr,
 		httpClient: http.Client{
 			Timeout:   0,
-			Transport: comm.DefaultReliableTransport,
+			Transport: transport,
 		},
 	}
 }
 
 // RegistryDestName ...
 func (c Client) RegistryDestName(req RegistryDestNameReq) error {
-	url := fmt.Sprintf("%s://%s/registry", c.schema, c.addr)
-	reqJSON, err := json.Marshal(req)
+	_, err := c.Registry(req)
+	return err
+}
+
+// Registry 与 RegistryDestName 相同，并返回 destination 实际生效的配置
+func (c Client) Registry(req RegistryDestNameReq) (*RegistryResp, error) {
+	registryResp := &RegistryResp{}
+	err := c.post("/registry", req, registryResp)
 	if err != nil {
-		return err
+		return registryResp, err
 	}
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqJSON))
+	return registryResp, nil
+}
+
+// Consume 消费一条消息，消费者处理完成后需要在租约到期前调用 Ack 确认。
+// 指定 WaitSeconds 时，等待超时后返回的 ConsumeResp.TimedOut 为 true
+func (c Client) Consume(req ConsumeReq) (*ConsumeResp, error) {
+	consumeResp := &ConsumeResp{}
+	err := c.post("/consume", req, consumeResp)
 	if err != nil {
-		return err
+		return consumeResp, err
 	}
-	resp, err := c.httpClient.Do(request)
+	return consumeResp, nil
+}
+
+// Product 生产一条消息
+func (c Client) Product(req ProductReq) error {
+	_, err := c.ProductWithResp(req)
+	return err
+}
+
+// ProductWithResp 与 Product 相同，并返回服务端为消息分配的 id
+func (c Client) ProductWithResp(req ProductReq) (*ProductResp, error) {
+	productResp := &ProductResp{}
+	err := c.post("/product", req, productResp)
 	if err != nil {
-		return err
+		return productResp, err
 	}
-	defer resp.Body.Close()
+	return productResp, nil
+}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+// ProductBatch 批量生产消息，Atomic 为 false 时需要检查每条消息的结果
+func (c Client) ProductBatch(req ProductBatchReq) (*ProductBatchResp, error) {
+	productBatchResp := &ProductBatchResp{}
+	err := c.post("/product/batch", req, productBatchResp)
 	if err != nil {
-		logrus.Errorf("failed to read all body from registry resp, error = %v", err)
-		return err
+		return productBatchResp, err
 	}
-	respData := new(comm.ResponseData)
-	err = json.Unmarshal(respBody, respData)
+	return productBatchResp, nil
+}
+
+// ConsumeBatch 批量消费消息，每条消息都需要单独确认
+func (c Client) ConsumeBatch(req ConsumeBatchReq) (*ConsumeBatchResp, error) {
+	consumeBatchResp := &ConsumeBatchResp{}
+	err := c.post("/consume/batch", req, consumeBatchResp)
 	if err != nil {
-		logrus.Errorf("failed to unmarshal resp Body [%s] to respData %#v, error = %v", respBody, respData, err)
-		return err
+		return consumeBatchResp, err
 	}
+	return consumeBatchResp, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%s", respData.Err)
+// Ack 确认消息已处理
+func (c Client) Ack(req AckReq) error {
+	return c.post("/ack", req, nil)
+}
+
+// Nack 释放消息，消息会被重新投递
+func (c Client) Nack(req NackReq) error {
+	return c.post("/nack", req, nil)
+}
+
+// Leave 离开消费组，分区模式下消费者的分区立即分配给组内其他消费者
+func (c Client) Leave(req LeaveReq) error {
+	return c.post("/leave", req, nil)
+}
+
+// CreateReplyDest 创建所有者为 req.ConsumerId 的临时 destination，用于接收请求的响应。
+// 只有所有者可以消费，所有者调用 Leave 离开或超过会话超时没有消费后 destination 被删除
+func (c Client) CreateReplyDest(req ReplyDestReq) (*ReplyDestResp, error) {
+	replyDestResp := &ReplyDestResp{}
+	err := c.post("/reply/create", req, replyDestResp)
+	if err != nil {
+		return replyDestResp, err
 	}
+	return replyDestResp, nil
+}
 
-	return nil
+// Call 向 destName 发送请求并等待 CorrelationId 相同的响应，ctx 没有截止时间时最多等待 defaultCallTimeout。
+// 每次调用使用一个临时 destination 接收响应，返回前将其删除
+func (c Client) Call(ctx context.Context, destName string, payload []byte) (*ConsumeResp, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCallTimeout)
+		defer cancel()
+	}
+	owner := uuid.New().String()
+	replyDest, err := c.CreateReplyDest(ReplyDestReq{ConsumerId: owner})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := c.Leave(LeaveReq{DestName: replyDest.DestName, ConsumerId: owner})
+		if err != nil {
+			logrus.WithField("destName", replyDest.DestName).Warnf("failed to leave reply dest, error = %v", err)
+		}
+	}()
+
+	correlationId := uuid.New().String()
+	err = c.Product(ProductReq{
+		DestName:      destName,
+		Body:          payload,
+		ReplyTo:       replyDest.DestName,
+		CorrelationId: correlationId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		deadline, _ := ctx.Deadline()
+		waitSeconds := int(time.Until(deadline) / time.Second)
+		if waitSeconds < 1 {
+			waitSeconds = 1
+		}
+		consumeResp := &ConsumeResp{}
+		err = c.postContext(ctx, "/consume", ConsumeReq{
+			DestName:    replyDest.DestName,
+			ConsumerId:  owner,
+			WaitSeconds: waitSeconds,
+		}, consumeResp)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no reply from dest name %s before timeout, %v", destName, ctx.Err())
+		}
+		if err != nil {
+			return nil, err
+		}
+		if consumeResp.TimedOut {
+			continue
+		}
+		err = c.Ack(AckReq{DestName: replyDest.DestName, Id: consumeResp.Id, Lease: consumeResp.Lease})
+		if err != nil {
+			logrus.WithField("destName", replyDest.DestName).Warnf("failed to ack reply %s, error = %v", consumeResp.Id, err)
+		}
+		if consumeResp.CorrelationId == correlationId {
+			return consumeResp, nil
+		}
+		logrus.WithField("destName", replyDest.DestName).
+			Warnf("discard reply with unexpected correlation id %s", consumeResp.CorrelationId)
+	}
 }
 
-// Consume ...
-func (c Client) Consume(req ConsumeReq) (*ConsumeResp, error) {
-	consumeResp := &ConsumeResp{}
-	url := fmt.Sprintf("%s://%s/consume", c.schema, c.addr)
-	reqJSON, err := json.Marshal(req)
+// Reply 将响应写入请求的 ReplyTo，并带上请求的 CorrelationId
+func (c Client) Reply(request *ConsumeResp, payload []byte) error {
+	if request.ReplyTo == "" {
+		return fmt.Errorf("msg %s has no replyTo", request.Id)
+	}
+	return c.Product(ProductReq{
+		DestName:      request.ReplyTo,
+		Body:          payload,
+		CorrelationId: request.CorrelationId,
+	})
+}
+
+// SubscribeTopic 订阅 topic，订阅是一个独立的 destination，可以直接使用 Consume 消费
+func (c Client) SubscribeTopic(req SubscribeTopicReq) error {
+	return c.post("/topic/subscribe", req, nil)
+}
+
+// UnsubscribeTopic 取消订阅 topic，订阅中积压的消息会被删除
+func (c Client) UnsubscribeTopic(req UnsubscribeTopicReq) error {
+	return c.post("/topic/unsubscribe", req, nil)
+}
+
+// Publish 发布消息到 topic 的所有订阅
+func (c Client) Publish(req PublishReq) (*PublishResp, error) {
+	publishResp := &PublishResp{}
+	err := c.post("/topic/publish", req, publishResp)
 	if err != nil {
-		return consumeResp, err
+		return publishResp, err
 	}
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqJSON))
+	return publishResp, nil
+}
+
+// RedriveDeadLetter 将死信 destination 中的消息送回其原始的 destination
+func (c Client) RedriveDeadLetter(req RedriveReq) (*RedriveResp, error) {
+	redriveResp := &RedriveResp{}
+	err := c.post("/deadletter/redrive", req, redriveResp)
 	if err != nil {
-		return consumeResp, err
+		return redriveResp, err
 	}
-	resp, err := c.httpClient.Do(request)
+	return redriveResp, nil
+}
+
+// DeclareExchange 创建 exchange，已存在且类型相同时直接返回
+func (c Client) DeclareExchange(req DeclareExchangeReq) (*DeclareExchangeResp, error) {
+	declareExchangeResp := &DeclareExchangeResp{}
+	err := c.post("/exchange/declare", req, declareExchangeResp)
 	if err != nil {
-		return consumeResp, err
+		return declareExchangeResp, err
 	}
-	defer resp.Body.Close()
+	return declareExchangeResp, nil
+}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+// DeleteExchange 删除 exchange 及其所有绑定
+func (c Client) DeleteExchange(req DeleteExchangeReq) error {
+	return c.post("/exchange/delete", req, nil)
+}
+
+// ListExchange 列出所有 exchange 及其绑定
+func (c Client) ListExchange() (*ListExchangeResp, error) {
+	listExchangeResp := &ListExchangeResp{}
+	err := c.post("/exchange/list", struct{}{}, listExchangeResp)
 	if err != nil {
-		logrus.Errorf("failed to read all body from consume resp, error = %v", err)
-		return nil, err
+		return listExchangeResp, err
 	}
+	return listExchangeResp, nil
+}
 
-	respData := new(comm.ResponseData)
-	respData.Data = consumeResp
-	err = json.Unmarshal(respBody, respData)
+// BindExchange 将 destination 绑定到 exchange
+func (c Client) BindExchange(req BindingReq) error {
+	return c.post("/exchange/bind", req, nil)
+}
+
+// UnbindExchange 解除 exchange 与 destination 的绑定
+func (c Client) UnbindExchange(req BindingReq) error {
+	return c.post("/exchange/unbind", req, nil)
+}
+
+// PublishExchange 发布消息到 exchange，消息没有路由到任何 destination 时 Unroutable 为 true，
+// 请求中 Mandatory 为 true 时同时返回错误
+func (c Client) PublishExchange(req ExchangePublishReq) (*ExchangePublishResp, error) {
+	exchangePublishResp := &ExchangePublishResp{}
+	err := c.post("/exchange/publish", req, exchangePublishResp)
 	if err != nil {
-		logrus.Errorf("failed to unmarshal resp Body [%s] to respData %#v, error = %v", respBody, respData, err)
-		return consumeResp, err
+		return exchangePublishResp, err
 	}
+	return exchangePublishResp, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return consumeResp, fmt.Errorf("%s", respData.Err)
+// CreateStream 创建 stream，已存在且保留策略一致时直接返回
+func (c Client) CreateStream(req CreateStreamReq) (*CreateStreamResp, error) {
+	createStreamResp := &CreateStreamResp{}
+	err := c.post("/stream/create", req, createStreamResp)
+	if err != nil {
+		return createStreamResp, err
 	}
+	return createStreamResp, nil
+}
 
-	consumeResp, ok := respData.Data.(*ConsumeResp)
-	if !ok {
-		return consumeResp, fmt.Errorf("failed to assert resp data %T to ConsumeResp", respData.Data)
+// DeleteStream 删除 stream 及其所有消息
+func (c Client) DeleteStream(req StreamReq) error {
+	return c.post("/stream/delete", req, nil)
+}
+
+// DescribeStream 查看 stream 保留的消息范围与各消费组的消费位置
+func (c Client) DescribeStream(req StreamReq) (*StreamInfo, error) {
+	streamInfo := &StreamInfo{}
+	err := c.post("/stream/describe", req, streamInfo)
+	if err != nil {
+		return streamInfo, err
 	}
+	return streamInfo, nil
+}
 
-	return consumeResp, nil
+// AppendStream 向 stream 写入消息，返回消息的 offset
+func (c Client) AppendStream(req AppendStreamReq) (*AppendStreamResp, error) {
+	appendStreamResp := &AppendStreamResp{}
+	err := c.post("/stream/append", req, appendStreamResp)
+	if err != nil {
+		return appendStreamResp, err
+	}
+	return appendStreamResp, nil
 }
 
-func (c Client) Product(req ProductReq) error {
-	url := fmt.Sprintf("%s://%s/product", c.schema, c.addr)
+// ReadStream 读取 stream 中的消息，读取不会移动消费组的消费位置，处理完成后使用 CommitStreamOffset 提交 NextOffset
+func (c Client) ReadStream(req ReadStreamReq) (*ReadStreamResp, error) {
+	readStreamResp := &ReadStreamResp{}
+	err := c.post("/stream/read", req, readStreamResp)
+	if err != nil {
+		return readStreamResp, err
+	}
+	return readStreamResp, nil
+}
+
+// CommitStreamOffset 提交消费组的消费位置
+func (c Client) CommitStreamOffset(req CommitStreamOffsetReq) error {
+	return c.post("/stream/commit", req, nil)
+}
+
+// SeekStream 将消费组的消费位置移动到最早的消息、末尾或指定的时间，返回移动后的 offset
+func (c Client) SeekStream(req SeekStreamReq) (*SeekStreamResp, error) {
+	seekStreamResp := &SeekStreamResp{}
+	err := c.post("/stream/seek", req, seekStreamResp)
+	if err != nil {
+		return seekStreamResp, err
+	}
+	return seekStreamResp, nil
+}
+
+// BeginTx 开始事务，事务中暂存的消息在 CommitTx 之前对消费者不可见
+func (c Client) BeginTx(req BeginTxReq) (*BeginTxResp, error) {
+	beginTxResp := &BeginTxResp{}
+	err := c.post("/tx/begin", req, beginTxResp)
+	if err != nil {
+		return beginTxResp, err
+	}
+	return beginTxResp, nil
+}
+
+// TxPut 在事务中暂存一条消息，返回消息 id
+func (c Client) TxPut(req TxPutReq) (*ProductResp, error) {
+	productResp := &ProductResp{}
+	err := c.post("/tx/put", req, productResp)
+	if err != nil {
+		return productResp, err
+	}
+	return productResp, nil
+}
+
+// CommitTx 提交事务，事务中的消息全部写入或全部不写入，提交失败时可以重试或放弃事务
+func (c Client) CommitTx(req TxReq) (*CommitTxResp, error) {
+	commitTxResp := &CommitTxResp{}
+	err := c.post("/tx/commit", req, commitTxResp)
+	if err != nil {
+		return commitTxResp, err
+	}
+	return commitTxResp, nil
+}
+
+// AbortTx 放弃事务
+func (c Client) AbortTx(req TxReq) error {
+	return c.post("/tx/abort", req, nil)
+}
+
+// ListDest 列出所有 destination
+func (c Client) ListDest() (*ListDestResp, error) {
+	listDestResp := &ListDestResp{}
+	err := c.post("/admin/list", struct{}{}, listDestResp)
+	if err != nil {
+		return listDestResp, err
+	}
+	return listDestResp, nil
+}
+
+// DescribeDest 查看 destination 的配置与各消费组的积压情况
+func (c Client) DescribeDest(req DescribeDestReq) (*DestInfo, error) {
+	destInfo := &DestInfo{}
+	err := c.post("/admin/describe", req, destInfo)
+	if err != nil {
+		return destInfo, err
+	}
+	return destInfo, nil
+}
+
+// DeleteDest 删除 destination 及其所有消息
+func (c Client) DeleteDest(req DeleteDestReq) error {
+	return c.post("/admin/delete", req, nil)
+}
+
+// PurgeDest 清空 destination 中的消息，返回删除的消息数
+func (c Client) PurgeDest(req PurgeDestReq) (*PurgeDestResp, error) {
+	purgeDestResp := &PurgeDestResp{}
+	err := c.post("/admin/purge", req, purgeDestResp)
+	if err != nil {
+		return purgeDestResp, err
+	}
+	return purgeDestResp, nil
+}
+
+// SetDestCapacity 修改 destination 的容量
+func (c Client) SetDestCapacity(req SetDestCapacityReq) error {
+	return c.post("/admin/capacity", req, nil)
+}
+
+// post 以 json 格式发送请求，并将响应中的 data 解析到 data 中
+func (c Client) post(path string, req interface{}, data interface{}) error {
+	return c.postContext(context.Background(), path, req, data)
+}
+
+// postContext 与 post 相同，ctx 结束时取消请求
+func (c Client) postContext(ctx context.Context, path string, req interface{}, data interface{}) error {
+	url := fmt.Sprintf("%s://%s%s", c.schema, c.addr, path)
 	reqJSON, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
-	request, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqJSON))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqJSON))
 	if err != nil {
 		return err
 	}
@@ -126,11 +475,12 @@ func (c Client) Product(req ProductReq) error {
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		logrus.Errorf("failed to read all body from product resp, error = %v", err)
+		logrus.Errorf("failed to read all body from %s resp, error = %v", path, err)
 		return err
 	}
 
 	respData := new(comm.ResponseData)
+	respData.Data = data
 	err = json.Unmarshal(respBody, respData)
 	if err != nil {
 		logrus.Errorf("failed to unmarshal resp body [%s] to respData %#v, error = %v", respBody, respData, err)
@@ -144,19 +494,554 @@ func (c Client) Product(req ProductReq) error {
 	return nil
 }
 
+// RegistryDestNameReq 注册 destination 并加入消费组，destination 已存在时请求中指定的配置需要与已有的配置一致，未指定的配置不参与比较
 type RegistryDestNameReq struct {
 	DestName string `json:"destName,omitempty"`
+	// Group 消费组，为空时使用默认消费组
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// MaxDeliveries 消息投递失败的最大次数，达到后消息转入 DeadLetterDest
+	MaxDeliveries  int    `json:"maxDeliveries,omitempty"`
+	DeadLetterDest string `json:"deadLetterDest,omitempty"`
+	// TTLSeconds 消息默认的存活时间，单位秒
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// DeadLetterExpired 为 true 时过期的消息转入 DeadLetterDest，为 false 时不参与比较，
+	// 使用已有 destination 或模板的配置
+	DeadLetterExpired bool `json:"deadLetterExpired,omitempty"`
+	// MaxPriority 大于 0 时开启优先级模式，消息优先级的取值范围为 0 到 MaxPriority
+	MaxPriority int `json:"maxPriority,omitempty"`
+	// StarvationSeconds 大于 0 时开启防饥饿，低优先级消息等待超过该秒数后优先投递
+	StarvationSeconds int `json:"starvationSeconds,omitempty"`
+	// Capacity 每个消费组队列最多容纳的消息数，为 0 时使用默认值
+	Capacity int `json:"capacity,omitempty"`
+	// MaxBytes 每个消费组队列中消息内容的总字节数上限，为 0 时不限制
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// OverflowPolicy 队列已满时的处理策略，见 OverflowReject 等常量，默认为 OverflowReject
+	OverflowPolicy string `json:"overflowPolicy,omitempty"`
+	// BlockTimeoutSeconds OverflowBlock 策略下生产者最多等待的秒数，为 0 时使用默认值
+	BlockTimeoutSeconds int `json:"blockTimeoutSeconds,omitempty"`
+	// DedupWindowSeconds 带有幂等键的消息的去重窗口，单位秒，为 0 时使用默认值
+	DedupWindowSeconds int `json:"dedupWindowSeconds,omitempty"`
+	// DedupMaxEntries 去重窗口内最多记录的幂等键数，为 0 时使用默认值
+	DedupMaxEntries int `json:"dedupMaxEntries,omitempty"`
+	// Partitions 每个消费组的分区数，大于 1 时开启分区模式，相同分区键的消息按顺序投递给同一个消费者
+	Partitions int `json:"partitions,omitempty"`
+	// Force 为 true 时，已有的 destination 配置与请求不一致则删除并重新创建，其中的消息全部丢弃
+	Force bool `json:"force,omitempty"`
+}
+
+// RegistryResp 返回 destination 实际生效的配置
+type RegistryResp struct {
+	Options DestOptions `json:"options"`
+	// Created 为 true 时表示本次注册新建了 destination
+	Created bool `json:"created,omitempty"`
 }
 
 type ConsumeReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Prefetch 该消费者最多可以持有的未确认消息数，为 0 或未指定 ConsumerId 时不限制
+	Prefetch int `json:"prefetch,omitempty"`
+	// VisibilityTimeout 租约时长，单位秒，超时未确认的消息会被重新投递
+	VisibilityTimeout int `json:"visibilityTimeout,omitempty"`
+	// WaitSeconds 没有消息时最多等待的秒数，为 0 时一直等待到有消息或请求结束
+	WaitSeconds int `json:"waitSeconds,omitempty"`
+}
+
+// ReplyDestReq 创建临时的响应 destination
+type ReplyDestReq struct {
+	// ConsumerId 临时 destination 的所有者，只有所有者可以消费
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Capacity 队列的容量，为 0 时使用默认值
+	Capacity int `json:"capacity,omitempty"`
+	// TTLSeconds 响应默认的存活时间，单位秒，为 0 时不过期
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+}
+
+type ReplyDestResp struct {
 	DestName string `json:"destName,omitempty"`
 }
 
+type LeaveReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+}
+
 type ConsumeResp struct {
-	Msg string `json:"msg,omitempty"`
+	Id string `json:"id,omitempty"`
+	// Msg 合法 UTF-8 编码的文本消息的内容，其余消息的内容在 Body 中
+	Msg           string            `json:"msg,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ReplyTo       string            `json:"replyTo,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	Lease         string            `json:"lease,omitempty"`
+	LeaseExpireAt time.Time         `json:"leaseExpireAt,omitempty"`
+	// Failures 消息此前投递失败的次数
+	Failures int `json:"failures,omitempty"`
+	// DeadLetter 死信消息的元数据，普通消息为空
+	DeadLetter *DeadLetterInfo `json:"deadLetter,omitempty"`
+	// TimedOut 为 true 时表示等待超时，没有消费到消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+// Bytes 返回消息内容，文本消息与二进制消息均可使用
+func (r *ConsumeResp) Bytes() []byte {
+	if r.Body != nil {
+		return r.Body
+	}
+	return []byte(r.Msg)
+}
+
+type SubscribeReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Credit 最多推送的未确认消息数，为 0 时使用默认值
+	Credit int `json:"credit,omitempty"`
+	// VisibilityTimeout 租约时长，单位秒，超时未确认的消息会被重新投递
+	VisibilityTimeout int `json:"visibilityTimeout,omitempty"`
 }
 
 type ProductReq struct {
 	DestName string `json:"destName,omitempty"`
-	Msg      string `json:"msg,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// DeliverAt 消息的投递时间，在此之前消息对消费者不可见
+	DeliverAt *time.Time `json:"deliverAt,omitempty"`
+	// DelaySeconds 消息延迟投递的秒数，不能与 DeliverAt 同时指定
+	DelaySeconds int `json:"delaySeconds,omitempty"`
+	// TTLSeconds 消息的存活时间，单位秒，延迟消息从投递时间开始计算，为 0 时使用 destination 的默认值
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Priority 消息的优先级，只能用于优先级模式的 destination，数值越大越先投递
+	Priority int `json:"priority,omitempty"`
+	// IdempotencyKey 幂等键，去重窗口内使用相同幂等键生产的消息只会写入一次
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// ProducerId 与 Seq 未指定 IdempotencyKey 时作为幂等键，同一个生产者的每条消息使用不同的 Seq
+	ProducerId string `json:"producerId,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+	// PartitionKey 分区键，分区模式下相同分区键的消息写入同一个分区，按顺序投递
+	PartitionKey string `json:"partitionKey,omitempty"`
+	// ReplyTo 请求的响应写入的 destination，见 CreateReplyDest
+	ReplyTo string `json:"replyTo,omitempty"`
+	// CorrelationId 关联请求与响应，响应使用请求的 CorrelationId
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+type ProductResp struct {
+	Id string `json:"id,omitempty"`
+	// Duplicate 为 true 时表示消息已经生产过，Id 为原消息的 id
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+type ProductBatchReq struct {
+	DestName string `json:"destName,omitempty"`
+	// Atomic 为 true 时全部消息都写入成功或全部不写入，否则逐条写入并分别返回结果
+	Atomic bool `json:"atomic,omitempty"`
+	// Messages 待写入的消息，其中的 DestName 可以省略
+	Messages []ProductReq `json:"messages,omitempty"`
+}
+
+type ProductBatchResp struct {
+	// Results 与请求中的消息一一对应
+	Results []ProductBatchResult `json:"results,omitempty"`
+}
+
+type ProductBatchResult struct {
+	Id        string `json:"id,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Err       string `json:"err,omitempty"`
+}
+
+type DeclareExchangeReq struct {
+	Exchange string `json:"exchange,omitempty"`
+	// Type exchange 的类型，ExchangeDirect、ExchangeFanout、ExchangeTopic 或 ExchangeHeaders
+	Type string `json:"type,omitempty"`
+}
+
+type DeclareExchangeResp struct {
+	// Created 为 true 时表示本次请求新建了 exchange
+	Created bool `json:"created,omitempty"`
+}
+
+type DeleteExchangeReq struct {
+	Exchange string `json:"exchange,omitempty"`
+}
+
+// BindingReq 绑定或解除绑定 exchange 与 destination，解除绑定时各字段需要与绑定时相同
+type BindingReq struct {
+	Exchange string `json:"exchange,omitempty"`
+	DestName string `json:"destName,omitempty"`
+	// RoutingKey direct 类型为完整的路由键，topic 类型为以 . 分隔的模式，* 匹配一个单词，# 匹配零个或多个单词
+	RoutingKey string `json:"routingKey,omitempty"`
+	// Headers headers 类型要匹配的消息 Headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Match headers 类型的匹配方式，MatchAll 或 MatchAny，默认为 MatchAll
+	Match string `json:"match,omitempty"`
+}
+
+type Binding struct {
+	DestName   string            `json:"destName"`
+	RoutingKey string            `json:"routingKey,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Match      string            `json:"match,omitempty"`
+}
+
+type ExchangeInfo struct {
+	Name     string    `json:"name,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Bindings []Binding `json:"bindings,omitempty"`
+}
+
+type ListExchangeResp struct {
+	Exchanges []ExchangeInfo `json:"exchanges,omitempty"`
+}
+
+type ExchangePublishReq struct {
+	Exchange   string `json:"exchange,omitempty"`
+	RoutingKey string `json:"routingKey,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// ReplyTo 与 CorrelationId 见 ProductReq
+	ReplyTo       string `json:"replyTo,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Mandatory 为 true 时，消息没有路由到任何 destination 则返回错误
+	Mandatory bool `json:"mandatory,omitempty"`
+}
+
+type ExchangePublishResp struct {
+	Id string `json:"id,omitempty"`
+	// Routed 匹配的 destination
+	Routed []string `json:"routed,omitempty"`
+	// Delivered 成功写入的 destination 数
+	Delivered int `json:"delivered"`
+	// Failed 写入失败的 destination 及失败原因
+	Failed map[string]string `json:"failed,omitempty"`
+	// Unroutable 为 true 时表示消息没有匹配任何绑定，消息被丢弃
+	Unroutable bool `json:"unroutable,omitempty"`
+}
+
+type CreateStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// RetentionSeconds 消息保留的秒数，为 0 时不按时间清理
+	RetentionSeconds int `json:"retentionSeconds,omitempty"`
+	// RetentionBytes 保留的消息内容总字节数上限，超过后从最早的消息开始清理，为 0 时不限制
+	RetentionBytes int64 `json:"retentionBytes,omitempty"`
+}
+
+// StreamOptions stream 的保留策略，各字段的含义与 CreateStreamReq 中的同名字段相同
+type StreamOptions struct {
+	RetentionSeconds int   `json:"retentionSeconds,omitempty"`
+	RetentionBytes   int64 `json:"retentionBytes,omitempty"`
+}
+
+type CreateStreamResp struct {
+	Options StreamOptions `json:"options"`
+	// Created 为 true 时表示本次请求新建了 stream
+	Created bool `json:"created,omitempty"`
+}
+
+type StreamReq struct {
+	Stream string `json:"stream,omitempty"`
+}
+
+type AppendStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type AppendStreamResp struct {
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ReadStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// Group 消费组，未指定 Offset 时从消费组提交的位置开始读取，消费组第一次读取时从末尾开始
+	Group string `json:"group,omitempty"`
+	// Offset 开始读取的位置，指定时忽略消费组的消费位置
+	Offset *int64 `json:"offset,omitempty"`
+	// Max 最多读取的消息数，为 0 时使用默认值
+	Max int `json:"max,omitempty"`
+	// WaitSeconds 没有新消息时最多等待的秒数，为 0 时一直等待到有消息或请求结束
+	WaitSeconds int `json:"waitSeconds,omitempty"`
+}
+
+type StreamRecord struct {
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	// Msg 合法 UTF-8 编码的文本消息的内容，其余消息的内容在 Body 中
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Bytes 返回消息内容，文本消息与二进制消息均可使用
+func (r *StreamRecord) Bytes() []byte {
+	if r.Body != nil {
+		return r.Body
+	}
+	return []byte(r.Msg)
+}
+
+type ReadStreamResp struct {
+	Records []StreamRecord `json:"records,omitempty"`
+	// NextOffset 下一次读取的位置，处理完 Records 后提交该值
+	NextOffset int64 `json:"nextOffset"`
+	// TimedOut 为 true 时表示等待超时，没有新的消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type CommitStreamOffsetReq struct {
+	Stream string `json:"stream,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Offset 下一条要消费的消息的位置
+	Offset int64 `json:"offset"`
+}
+
+type SeekStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Position SeekBeginning、SeekEnd 或 SeekTimestamp
+	Position string `json:"position,omitempty"`
+	// Timestamp Position 为 SeekTimestamp 时移动到第一条写入时间不早于该时间的消息
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+type SeekStreamResp struct {
+	Offset int64 `json:"offset"`
+}
+
+// StreamInfo stream 保留的消息范围与各消费组的消费位置
+type StreamInfo struct {
+	Name    string        `json:"name,omitempty"`
+	Options StreamOptions `json:"options"`
+	// StartOffset 最早保留的消息的位置
+	StartOffset int64 `json:"startOffset"`
+	// EndOffset 下一条写入的消息的位置
+	EndOffset int64             `json:"endOffset"`
+	Messages  int               `json:"messages"`
+	Bytes     int64             `json:"bytes"`
+	Groups    []StreamGroupInfo `json:"groups,omitempty"`
+}
+
+type StreamGroupInfo struct {
+	Name   string `json:"name,omitempty"`
+	Offset int64  `json:"offset"`
+	// Lag 消费组尚未消费的消息数
+	Lag int64 `json:"lag"`
+}
+
+type BeginTxReq struct {
+	// TimeoutSeconds 事务的超时时间，超时未提交的事务自动放弃，为 0 时使用默认值
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+type BeginTxResp struct {
+	TxId     string    `json:"txId,omitempty"`
+	ExpireAt time.Time `json:"expireAt,omitempty"`
+}
+
+// TxPutReq 在事务中暂存一条消息，消息的字段与 ProductReq 相同，不支持幂等键
+type TxPutReq struct {
+	TxId string `json:"txId,omitempty"`
+	ProductReq
+}
+
+type TxReq struct {
+	TxId string `json:"txId,omitempty"`
+}
+
+type CommitTxResp struct {
+	// Ids 事务中所有消息的 id，按暂存的顺序排列
+	Ids []string `json:"ids,omitempty"`
+}
+
+type ConsumeBatchReq struct {
+	DestName          string `json:"destName,omitempty"`
+	Group             string `json:"group,omitempty"`
+	ConsumerId        string `json:"consumerId,omitempty"`
+	Prefetch          int    `json:"prefetch,omitempty"`
+	VisibilityTimeout int    `json:"visibilityTimeout,omitempty"`
+	WaitSeconds       int    `json:"waitSeconds,omitempty"`
+	// Max 最多返回的消息数，有消息可以投递时立即返回，不会等待凑满
+	Max int `json:"max,omitempty"`
+}
+
+type ConsumeBatchResp struct {
+	Messages []ConsumeResp `json:"messages,omitempty"`
+	// TimedOut 为 true 时表示等待超时，没有消费到消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type AckReq struct {
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Id       string `json:"id,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+}
+
+type NackReq struct {
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Id       string `json:"id,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+	// Error 处理失败的原因，消息转入死信时会被记录
+	Error string `json:"error,omitempty"`
+}
+
+type SubscribeTopicReq struct {
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	// Capacity 订阅的容量，只在创建订阅时生效
+	Capacity int `json:"capacity,omitempty"`
+}
+
+type UnsubscribeTopicReq struct {
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+}
+
+type PublishReq struct {
+	Topic string `json:"topic,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type PublishResp struct {
+	Id string `json:"id,omitempty"`
+	// Delivered 成功写入的订阅数
+	Delivered int `json:"delivered"`
+	// Failed 写入失败的订阅及失败原因
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+type RedriveReq struct {
+	// DestName 死信 destination
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	// Max 最多送回的消息数，为 0 时送回所有消息
+	Max int `json:"max,omitempty"`
+}
+
+type RedriveResp struct {
+	Redriven int `json:"redriven"`
+	Failed   int `json:"failed"`
+}
+
+// DeadLetterInfo 死信消息的元数据
+type DeadLetterInfo struct {
+	OriginalDest  string    `json:"originalDest,omitempty"`
+	OriginalGroup string    `json:"originalGroup,omitempty"`
+	Failures      int       `json:"failures,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	DeadAt        time.Time `json:"deadAt,omitempty"`
+}
+
+type ListDestResp struct {
+	Destinations []DestSummary `json:"destinations,omitempty"`
+}
+
+type DestSummary struct {
+	Name    string      `json:"name,omitempty"`
+	Options DestOptions `json:"options"`
+}
+
+type DescribeDestReq struct {
+	DestName string `json:"destName,omitempty"`
+}
+
+type DestInfo struct {
+	Name    string      `json:"name,omitempty"`
+	Options DestOptions `json:"options"`
+	// Owner 临时 destination 的所有者，普通 destination 为空
+	Owner  string      `json:"owner,omitempty"`
+	Groups []GroupInfo `json:"groups,omitempty"`
+}
+
+// DestOptions destination 的配置，各字段的含义与 RegistryDestNameReq 中的同名字段相同
+type DestOptions struct {
+	Capacity            int    `json:"capacity,omitempty"`
+	MaxDeliveries       int    `json:"maxDeliveries,omitempty"`
+	DeadLetterDest      string `json:"deadLetterDest,omitempty"`
+	TTLSeconds          int    `json:"ttlSeconds,omitempty"`
+	DeadLetterExpired   bool   `json:"deadLetterExpired,omitempty"`
+	MaxPriority         int    `json:"maxPriority,omitempty"`
+	StarvationSeconds   int    `json:"starvationSeconds,omitempty"`
+	MaxBytes            int64  `json:"maxBytes,omitempty"`
+	OverflowPolicy      string `json:"overflowPolicy,omitempty"`
+	BlockTimeoutSeconds int    `json:"blockTimeoutSeconds,omitempty"`
+	DedupWindowSeconds  int    `json:"dedupWindowSeconds,omitempty"`
+	DedupMaxEntries     int    `json:"dedupMaxEntries,omitempty"`
+	Partitions          int    `json:"partitions,omitempty"`
+}
+
+// GroupInfo 消费组队列的状态
+type GroupInfo struct {
+	Name string `json:"name,omitempty"`
+	// Depth 尚未确认的消息总数，包括 Ready、Inflight 与 Scheduled
+	Depth     int `json:"depth"`
+	Ready     int `json:"ready"`
+	Inflight  int `json:"inflight"`
+	Scheduled int `json:"scheduled"`
+	Capacity  int `json:"capacity"`
+	// Bytes 队列中消息内容的总字节数
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// Consumers 消费组中活跃的消费者数
+	Consumers int `json:"consumers"`
+	// OldestMessageAgeSeconds 等待投递或未确认的消息中最早写入的消息的存在时长
+	OldestMessageAgeSeconds float64 `json:"oldestMessageAgeSeconds"`
+	// Partitions 分区模式下每个分区的状态
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+}
+
+// PartitionInfo 消费组中一个分区的状态
+type PartitionInfo struct {
+	Partition int `json:"partition"`
+	// Owner 分区当前分配给的消费者，没有活跃的消费者时为空
+	Owner     string `json:"owner,omitempty"`
+	Depth     int    `json:"depth"`
+	Ready     int    `json:"ready"`
+	Inflight  int    `json:"inflight"`
+	Scheduled int    `json:"scheduled"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type DeleteDestReq struct {
+	DestName string `json:"destName,omitempty"`
+}
+
+type PurgeDestReq struct {
+	DestName string `json:"destName,omitempty"`
+	// Group 为空时清空所有消费组
+	Group string `json:"group,omitempty"`
+}
+
+type PurgeDestResp struct {
+	Purged int `json:"purged"`
+}
+
+type SetDestCapacityReq struct {
+	DestName string `json:"destName,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+	// MaxBytes 为 nil 时不修改字节数上限，为 0 时取消限制
+	MaxBytes *int64 `json:"maxBytes,omitempty"`
 }
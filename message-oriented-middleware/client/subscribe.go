@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"technology/message-oriented-middleware/comm"
+)
+
+// Subscription 一个长连接订阅，broker 推送的消息从 Messages 中读取，
+// 每条消息处理完成后需要调用 Ack 或 Nack，否则未确认的消息数达到 credit 后 broker 会暂停推送
+type Subscription struct {
+	Messages <-chan *ConsumeResp
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+	once     sync.Once
+}
+
+// Subscribe 建立长连接订阅，ctx 结束或调用 Subscription.Close 后订阅结束
+func (c Client) Subscribe(ctx context.Context, req SubscribeReq) (*Subscription, error) {
+	url := fmt.Sprintf("%s://%s%s", c.schema, c.addr, "/subscribe")
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqJSON))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		respData := new(comm.ResponseData)
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			err = json.Unmarshal(respBody, respData)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe, status = %s", resp.Status)
+		}
+		return nil, fmt.Errorf("%s", respData.Err)
+	}
+
+	messages := make(chan *ConsumeResp)
+	s := &Subscription{
+		Messages: messages,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go s.receive(ctx, resp.Body, messages)
+	return s, nil
+}
+
+func (s *Subscription) receive(ctx context.Context, body io.ReadCloser, messages chan<- *ConsumeResp) {
+	defer close(s.done)
+	defer close(messages)
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for {
+		m := new(ConsumeResp)
+		err := decoder.Decode(m)
+		if err != nil {
+			if ctx.Err() == nil && err != io.EOF {
+				s.err = err
+			}
+			return
+		}
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close 结束订阅，已推送但未确认的消息会在租约到期后重新投递
+func (s *Subscription) Close() error {
+	s.once.Do(s.cancel)
+	<-s.done
+	return s.err
+}
+
+// Err 返回订阅异常结束的原因，应在 Messages 被关闭后调用
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"os"
 	"technology/message-oriented-middleware/conn/types"
 	"time"
 )
@@ -18,10 +19,29 @@ type ReliableTransport struct {
 
 // NewReliableTransport ...
 func NewReliableTransport() *ReliableTransport {
-	tr := http.Transport{
+	dialer := &net.Dialer{}
+	return NewReliableTransportWithDialer(dialer.DialContext)
+}
+
+// NewReliableUnixTransport 通过 unix domain socket 连接 broker，请求中的地址仅用于构造 url
+func NewReliableUnixTransport(socketPath string) *ReliableTransport {
+	dialer := &net.Dialer{}
+	return NewReliableTransportWithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	})
+}
+
+// NewReliablePipeTransport 通过进程内的 PipeListener 连接 broker
+func NewReliablePipeTransport(pl *PipeListener) *ReliableTransport {
+	return NewReliableTransportWithDialer(pl.DialContext)
+}
+
+// NewReliableTransportWithDialer 使用指定的拨号函数建立底层连接，并包装为 ReliableConn
+func NewReliableTransportWithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *ReliableTransport {
+	return &ReliableTransport{http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-			conn, err = net.Dial(network, addr)
+			conn, err = dial(ctx, network, addr)
 			if err != nil {
 				return nil, err
 			}
@@ -33,8 +53,7 @@ func NewReliableTransport() *ReliableTransport {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   0,
 		ExpectContinueTimeout: 0,
-	}
-	return &ReliableTransport{tr}
+	}}
 }
 
 type ReliableListener struct {
@@ -59,13 +78,28 @@ func (rl *ReliableListener) Accept() (net.Conn, error) {
 }
 
 func NewReliableListener(network, addr string) (*ReliableListener, error) {
-	var err error
-	rl := new(ReliableListener)
-	rl.listener, err = net.Listen(network, addr)
+	l, err := Listen(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return rl, nil
+	return WrapReliableListener(l), nil
+}
+
+// WrapReliableListener 使用已有的 listener 构造 ReliableListener
+func WrapReliableListener(l net.Listener) *ReliableListener {
+	return &ReliableListener{listener: l}
+}
+
+// Listen 与 net.Listen 相同，但监听 unix domain socket 前会清理残留的 socket 文件
+func Listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(network, addr)
 }
 
 // ResponseData ...
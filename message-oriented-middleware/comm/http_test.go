@@ -0,0 +1,65 @@
+package comm
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReliableUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "broker.sock")
+
+	// 模拟进程异常退出后残留的 socket 文件，Listen 需要先将其清理
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ml, err := NewMixedListener("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen on stale socket file: %v", err)
+	}
+	serve(t, ml)
+
+	client := &http.Client{Transport: NewReliableUnixTransport(socketPath), Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	if got := doRequest(t, client, http.MethodPost, "http://unix/product", "msg"); got != "POST /product msg" {
+		t.Fatalf("response = %q, want %q", got, "POST /product msg")
+	}
+}
+
+func TestReliablePipeTransport(t *testing.T) {
+	pl := NewPipeListener("broker")
+	serve(t, WrapMixedListener(pl))
+
+	client := &http.Client{Transport: NewReliablePipeTransport(pl), Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		if got := doRequest(t, client, http.MethodPost, "http://broker/product", "msg"); got != "POST /product msg" {
+			t.Fatalf("response = %q, want %q", got, "POST /product msg")
+		}
+	}
+}
+
+func TestPipeListenerClose(t *testing.T) {
+	pl := NewPipeListener("broker")
+	pl.Close()
+	if _, err := pl.Accept(); err != listenerClosedError {
+		t.Fatalf("accept after close returned %v, want %v", err, listenerClosedError)
+	}
+	if _, err := pl.DialContext(context.Background(), "pipe", "broker"); err != listenerClosedError {
+		t.Fatalf("dial after close returned %v, want %v", err, listenerClosedError)
+	}
+}
@@ -0,0 +1,72 @@
+package comm
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// PipeListener 基于 net.Pipe 的进程内 listener，
+// 可以让生产者、broker、消费者在同一个进程中通信而无需占用端口
+type PipeListener struct {
+	name      string
+	connCh    chan net.Conn
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeListener ...
+func NewPipeListener(name string) *PipeListener {
+	return &PipeListener{
+		name:   name,
+		connCh: make(chan net.Conn),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// DialContext 创建一对内存连接，一端交给 Accept，另一端返回给调用方
+func (pl *PipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	select {
+	case pl.connCh <- serverConn:
+		return clientConn, nil
+	case <-ctx.Done():
+		clientConn.Close()
+		serverConn.Close()
+		return nil, ctx.Err()
+	case <-pl.stopCh:
+		clientConn.Close()
+		serverConn.Close()
+		return nil, listenerClosedError
+	}
+}
+
+func (pl *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.connCh:
+		return conn, nil
+	case <-pl.stopCh:
+		return nil, listenerClosedError
+	}
+}
+
+func (pl *PipeListener) Close() error {
+	pl.closeOnce.Do(func() {
+		close(pl.stopCh)
+	})
+	return nil
+}
+
+func (pl *PipeListener) Addr() net.Addr {
+	return pipeAddr(pl.name)
+}
+
+type pipeAddr string
+
+func (pa pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pa pipeAddr) String() string {
+	return string(pa)
+}
@@ -0,0 +1,176 @@
+package comm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"technology/message-oriented-middleware/conn/types"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sniffLength  = 8
+	sniffTimeout = 10 * time.Second
+
+	// 接收连接遇到临时错误时的退避时间
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+var (
+	httpMethodPrefixes = [][]byte{
+		[]byte("GET "),
+		[]byte("POST "),
+		[]byte("PUT "),
+		[]byte("DELETE "),
+		[]byte("HEAD "),
+		[]byte("OPTIONS "),
+		[]byte("PATCH "),
+		[]byte("CONNECT "),
+		[]byte("TRACE "),
+		[]byte("PRI "),
+	}
+
+	listenerClosedError = fmt.Errorf("listener has been closed")
+)
+
+// MixedListener 在同一个端口上同时提供原始 HTTP 与可靠帧协议的服务，
+// 接收连接后嗅探首部字节，形如 HTTP 请求行的连接直接交给 HTTP 服务处理，
+// 其余连接使用 ReliableConn 包装
+type MixedListener struct {
+	listener  net.Listener
+	connCh    chan net.Conn
+	errCh     chan error
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMixedListener ...
+func NewMixedListener(network, addr string) (*MixedListener, error) {
+	l, err := Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return WrapMixedListener(l), nil
+}
+
+// WrapMixedListener 使用已有的 listener 构造 MixedListener
+func WrapMixedListener(l net.Listener) *MixedListener {
+	ml := &MixedListener{
+		listener: l,
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error, 1),
+		stopCh:   make(chan struct{}),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+// acceptLoop 持续接收底层连接，每个连接在独立的协程中嗅探协议，
+// 避免慢连接阻塞其他连接的接收。临时错误（如文件描述符耗尽）退避后重试，
+// 只有 listener 被关闭或遇到不可恢复的错误时才退出
+func (ml *MixedListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := ml.listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			logrus.WithField("addr", ml.listener.Addr()).
+				Errorf("failed to accept conn, retrying in %v, error = %v", delay, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ml.stopCh:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case ml.errCh <- err:
+			case <-ml.stopCh:
+			}
+			return
+		}
+		delay = 0
+		go ml.sniff(conn)
+	}
+}
+
+func (ml *MixedListener) sniff(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(sniffLength)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logrus.WithField("remoteAddr", conn.RemoteAddr()).
+			Errorf("failed to sniff conn protocol, error = %v", err)
+		conn.Close()
+		return
+	}
+
+	var c net.Conn = &peekedConn{Conn: conn, reader: reader}
+	if !isHTTPRequestLine(head) {
+		c = types.NewReliableConn(c)
+	}
+	select {
+	case ml.connCh <- c:
+	case <-ml.stopCh:
+		c.Close()
+	}
+}
+
+func (ml *MixedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.connCh:
+		return conn, nil
+	case err := <-ml.errCh:
+		return nil, err
+	case <-ml.stopCh:
+		return nil, listenerClosedError
+	}
+}
+
+func (ml *MixedListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.stopCh)
+		err = ml.listener.Close()
+	})
+	return err
+}
+
+func (ml *MixedListener) Addr() net.Addr {
+	return ml.listener.Addr()
+}
+
+// isHTTPRequestLine 判断首部字节是否以 HTTP 方法开头
+func isHTTPRequestLine(head []byte) bool {
+	for _, prefix := range httpMethodPrefixes {
+		n := len(prefix)
+		if n > len(head) {
+			n = len(head)
+		}
+		if bytes.HasPrefix(head, prefix[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekedConn 先返回嗅探时缓存的字节，再从底层连接读取
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (pc *peekedConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
@@ -0,0 +1,145 @@
+package comm
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoHandler 返回请求的方法与路径，用于区分请求是否被正确处理
+var echoHandler http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	_, _ = writer.Write([]byte(request.Method + " " + request.URL.Path + " " + string(body)))
+}
+
+// serve 在 l 上启动 HTTP 服务，测试结束时关闭
+func serve(t *testing.T, l net.Listener) {
+	srv := &http.Server{Handler: echoHandler}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+}
+
+func doRequest(t *testing.T, client *http.Client, method, url, body string) string {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response of %s %s: %v", method, url, err)
+	}
+	return string(data)
+}
+
+func listenTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestMixedListenerServesHTTPAndReliable(t *testing.T) {
+	ml := WrapMixedListener(listenTCP(t))
+	serve(t, ml)
+	url := "http://" + ml.Addr().String()
+
+	plain := &http.Client{Timeout: 5 * time.Second}
+	reliable := &http.Client{Transport: NewReliableTransport(), Timeout: 5 * time.Second}
+	defer reliable.CloseIdleConnections()
+
+	// 两种协议的连接并发地通过同一个 listener
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if got := doRequest(t, plain, http.MethodGet, url+"/plain", ""); got != "GET /plain " {
+				t.Errorf("plain response = %q, want %q", got, "GET /plain ")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if got := doRequest(t, reliable, http.MethodPost, url+"/reliable", "body"); got != "POST /reliable body" {
+				t.Errorf("reliable response = %q, want %q", got, "POST /reliable body")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// temporaryError 模拟文件描述符耗尽等可重试的 Accept 错误
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener 前 failures 次 Accept 返回临时错误
+type flakyListener struct {
+	net.Listener
+	mutex    sync.Mutex
+	failures int
+}
+
+func (fl *flakyListener) Accept() (net.Conn, error) {
+	fl.mutex.Lock()
+	if fl.failures > 0 {
+		fl.failures--
+		fl.mutex.Unlock()
+		return nil, temporaryError{}
+	}
+	fl.mutex.Unlock()
+	return fl.Listener.Accept()
+}
+
+func TestMixedListenerRetriesTemporaryError(t *testing.T) {
+	ml := WrapMixedListener(&flakyListener{Listener: listenTCP(t), failures: 3})
+	serve(t, ml)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	if got := doRequest(t, client, http.MethodGet, "http://"+ml.Addr().String()+"/after-retry", ""); got != "GET /after-retry " {
+		t.Fatalf("response = %q, want %q", got, "GET /after-retry ")
+	}
+}
+
+func TestMixedListenerClose(t *testing.T) {
+	ml := WrapMixedListener(listenTCP(t))
+	if err := ml.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := ml.Accept(); err == nil {
+		t.Fatal("accept on closed listener succeeded, want error")
+	}
+}
+
+func TestIsHTTPRequestLine(t *testing.T) {
+	cases := []struct {
+		head string
+		want bool
+	}{
+		{"GET / HT", true},
+		{"POST /pr", true},
+		{"OPTIONS ", true},
+		{"PRI * HT", true},
+		{"GE", true},
+		{"GETX / H", false},
+		{"\x00\x00\x00\x01\x02", false},
+	}
+	for _, c := range cases {
+		if got := isHTTPRequestLine([]byte(c.head)); got != c.want {
+			t.Errorf("isHTTPRequestLine(%q) = %v, want %v", c.head, got, c.want)
+		}
+	}
+}
@@ -25,13 +25,25 @@ func main() {
 	for {
 
 		req := client.ConsumeReq{
-			DestName: TestDestName,
+			DestName:    TestDestName,
+			WaitSeconds: 10,
 		}
 		consumeResp, err := c.Consume(req)
 		if err != nil {
 			logrus.WithField("req", req).Errorf("failed to consume message, error = %v", err)
+		} else if consumeResp.TimedOut {
+			continue
 		} else {
 			logrus.Infof("success consume message %s", consumeResp.Msg)
+			ackReq := client.AckReq{
+				DestName: TestDestName,
+				Id:       consumeResp.Id,
+				Lease:    consumeResp.Lease,
+			}
+			err = c.Ack(ackReq)
+			if err != nil {
+				logrus.WithField("req", ackReq).Errorf("failed to ack message, error = %v", err)
+			}
 		}
 		time.Sleep(1 * time.Second)
 	}
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stats 统计队列中的消息，调用方不能持有锁
+func (q *Queue) stats(now time.Time) GroupInfo {
+	q.Lock()
+	defer q.Unlock()
+	info := GroupInfo{
+		Depth:     q.size(),
+		Ready:     q.ready.Len(),
+		Inflight:  len(q.inflight),
+		Scheduled: q.scheduled.Len(),
+		Capacity:  q.cap,
+		Bytes:     q.bytes,
+		MaxBytes:  q.maxBytes,
+	}
+	var oldest time.Time
+	observe := func(m *message) {
+		if !m.CreatedAt.IsZero() && (oldest.IsZero() || m.CreatedAt.Before(oldest)) {
+			oldest = m.CreatedAt
+		}
+	}
+	q.ready.Range(observe)
+	for _, f := range q.inflight {
+		observe(f.m)
+	}
+	if !oldest.IsZero() {
+		info.OldestMessageAgeSeconds = now.Sub(oldest).Seconds()
+	}
+	return info
+}
+
+// purge 删除队列中的所有消息，包括已投递未确认与延迟投递的消息，返回删除的消息数
+func (q *Queue) purge() int {
+	q.Lock()
+	defer q.Unlock()
+	n := q.size()
+	q.ready.RemoveIf(func(m *message) bool {
+		q.ack(m)
+		return true
+	})
+	for _, m := range q.scheduled {
+		q.ack(m)
+	}
+	q.scheduled = nil
+	for _, f := range q.inflight {
+		q.ack(f.m)
+	}
+	q.inflight = make(map[string]*inflightMsg)
+	q.consumerInflight = make(map[string]int)
+	q.nextExpireAt = time.Time{}
+	q.notify()
+	return n
+}
+
+// stats 汇总消费组所有分区的状态，分区模式下同时返回每个分区的状态与其分配给的消费者
+func (g *Group) stats(now time.Time) GroupInfo {
+	info := GroupInfo{Name: g.name}
+	var owners []string
+	if len(g.partitions) > 1 {
+		owners = g.owners(now)
+	}
+	for p, q := range g.partitions {
+		pi := q.stats(now)
+		info.Depth += pi.Depth
+		info.Ready += pi.Ready
+		info.Inflight += pi.Inflight
+		info.Scheduled += pi.Scheduled
+		info.Capacity += pi.Capacity
+		info.Bytes += pi.Bytes
+		info.MaxBytes += pi.MaxBytes
+		if pi.OldestMessageAgeSeconds > info.OldestMessageAgeSeconds {
+			info.OldestMessageAgeSeconds = pi.OldestMessageAgeSeconds
+		}
+		if len(g.partitions) == 1 {
+			continue
+		}
+		partition := PartitionInfo{
+			Partition: p,
+			Depth:     pi.Depth,
+			Ready:     pi.Ready,
+			Inflight:  pi.Inflight,
+			Scheduled: pi.Scheduled,
+			Bytes:     pi.Bytes,
+		}
+		if owners != nil {
+			partition.Owner = owners[p]
+		}
+		info.Partitions = append(info.Partitions, partition)
+	}
+	g.mutex.Lock()
+	info.Consumers = len(g.consumers)
+	g.mutex.Unlock()
+	return info
+}
+
+// Info 返回 destination 及其所有消费组的状态
+func (d *Destination) Info() DestInfo {
+	now := time.Now()
+	info := DestInfo{
+		Name:    d.name,
+		Options: d.Options(),
+		Owner:   d.owner,
+	}
+	for _, g := range d.Groups() {
+		info.Groups = append(info.Groups, g.stats(now))
+	}
+	sort.Slice(info.Groups, func(i, j int) bool {
+		return info.Groups[i].Name < info.Groups[j].Name
+	})
+	return info
+}
+
+// Purge 删除 group 中的所有消息，group 为空时删除所有消费组的消息，返回删除的消息数
+func (d *Destination) Purge(group string) (int, error) {
+	groups := d.Groups()
+	if group != "" {
+		g, err := d.Group(group)
+		if err != nil {
+			return 0, err
+		}
+		groups = []*Group{g}
+	}
+	n := 0
+	for _, g := range groups {
+		for _, q := range g.partitions {
+			n += q.purge()
+		}
+	}
+	return n, nil
+}
+
+// SetCapacity 修改所有消费组队列的容量，分区模式下为每个分区的容量，maxBytes 为 nil 时不修改字节数上限。
+// 容量小于当前积压时只拒绝新的消息，不会删除已有的消息
+func (d *Destination) SetCapacity(capacity int, maxBytes *int64) error {
+	if capacity <= 0 {
+		return fmt.Errorf("capacity must be positive")
+	}
+	if maxBytes != nil && *maxBytes < 0 {
+		return fmt.Errorf("maxBytes can not be negative")
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	opts := d.opts
+	opts.Capacity = capacity
+	if maxBytes != nil {
+		opts.MaxBytes = *maxBytes
+	}
+	err := saveMeta(filepath.Join(encodeDirName(d.name), metaFileName), opts)
+	if err != nil {
+		return err
+	}
+	d.opts = opts
+	for _, g := range d.groups {
+		for _, q := range g.partitions {
+			q.Lock()
+			q.cap = opts.Capacity
+			q.maxBytes = opts.MaxBytes
+			q.notifySpace()
+			q.Unlock()
+		}
+	}
+	return nil
+}
+
+// ListDest 列出所有 destination
+var ListDest http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept list dest request")
+	defer request.Body.Close()
+	dests := DestinationMap.List()
+	resp := ListDestResp{Destinations: make([]DestSummary, 0, len(dests))}
+	for _, dest := range dests {
+		resp.Destinations = append(resp.Destinations, DestSummary{Name: dest.name, Options: dest.Options()})
+	}
+	sort.Slice(resp.Destinations, func(i, j int) bool {
+		return resp.Destinations[i].Name < resp.Destinations[j].Name
+	})
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "list dest success",
+		Data: resp,
+	})
+}
+
+// DescribeDest 查看 destination 的配置与各消费组的积压情况
+var DescribeDest http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept describe dest request")
+	defer request.Body.Close()
+	v := new(DescribeDestReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	dest, ok := DestinationMap.Get(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "describe dest success",
+		Data: dest.Info(),
+	})
+}
+
+// DeleteDest 删除 destination 及其所有消息与 exchange 绑定，topic 的订阅需要通过取消订阅删除
+var DeleteDest http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept delete dest request")
+	defer request.Body.Close()
+	v := new(DeleteDestReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	if topic, ok := TopicMap.subscribedBy(v.DestName); ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("dest name %s is a subscription of topic %s, unsubscribe it instead", v.DestName, topic),
+		})
+		return
+	}
+	if _, ok := DestinationMap.Get(v.DestName); !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	err = DestinationMap.Delete(v.DestName)
+	if err == nil {
+		err = ExchangeMap.unbindDest(v.DestName)
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "delete dest success",
+	})
+}
+
+// PurgeDest 清空 destination 中的消息
+var PurgeDest http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept purge dest request")
+	defer request.Body.Close()
+	v := new(PurgeDestReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	dest, ok := DestinationMap.Get(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	n, err := dest.Purge(v.Group)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	logrus.WithField("destName", v.DestName).WithField("group", v.Group).Warnf("purged %d messages", n)
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "purge dest success",
+		Data: PurgeDestResp{Purged: n},
+	})
+}
+
+// SetDestCapacity 修改 destination 的容量
+var SetDestCapacity http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept set dest capacity request")
+	defer request.Body.Close()
+	v := new(SetDestCapacityReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	dest, ok := DestinationMap.Get(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	if v.Capacity <= 0 || (v.MaxBytes != nil && *v.MaxBytes < 0) {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "capacity must be positive and maxBytes can not be negative",
+		})
+		return
+	}
+	err = dest.SetCapacity(v.Capacity, v.MaxBytes)
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "set dest capacity success",
+		Data: RegistryResp{Options: dest.Options()},
+	})
+}
@@ -1,10 +1,10 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
 	"technology/message-oriented-middleware/comm"
 	"time"
 
@@ -12,14 +12,13 @@ import (
 )
 
 const (
-	defaultRetryInternal = 1 * time.Second
+	defaultRetryInternal     = 1 * time.Second
+	defaultVisibilityTimeout = 30 * time.Second
+	maxPriorityLimit         = 255
 )
 
 var (
-	ConsumeQueueMap = QueueMap{
-		keyMQueue: make(map[string]*Queue),
-		mutex:     sync.RWMutex{},
-	}
+	DestinationMap = NewDestMap()
 )
 
 // 消费者注册函数
@@ -34,9 +33,78 @@ var Registry http.HandlerFunc = func(writer http.ResponseWriter, request *http.R
 		})
 		return
 	}
-	ConsumeQueueMap.Add(v.DestName, NewQueue(10))
+	if v.DeadLetterDest != "" && v.DeadLetterDest == v.DestName {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "dead letter dest can not be the dest itself",
+		})
+		return
+	}
+	opts := DestOptions{
+		Capacity:            v.Capacity,
+		MaxDeliveries:       v.MaxDeliveries,
+		DeadLetterDest:      v.DeadLetterDest,
+		TTLSeconds:          v.TTLSeconds,
+		DeadLetterExpired:   v.DeadLetterExpired,
+		MaxPriority:         v.MaxPriority,
+		StarvationSeconds:   v.StarvationSeconds,
+		MaxBytes:            v.MaxBytes,
+		OverflowPolicy:      v.OverflowPolicy,
+		BlockTimeoutSeconds: v.BlockTimeoutSeconds,
+		DedupWindowSeconds:  v.DedupWindowSeconds,
+		DedupMaxEntries:     v.DedupMaxEntries,
+		Partitions:          v.Partitions,
+	}
+	err = opts.validate()
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if topic, ok := TopicMap.subscribedBy(v.DestName); ok && v.Force {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("dest name %s is a subscription of topic %s, can not be recreated", v.DestName, topic),
+		})
+		return
+	}
+	if dest, ok := DestinationMap.Get(v.DestName); ok && dest.temporary() && v.Force {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("dest name %s is a reply dest, can not be recreated", v.DestName),
+		})
+		return
+	}
+	dest, created, err := DestinationMap.Register(v.DestName, opts, v.Force)
+	if conflict, ok := err.(*OptionsConflictError); ok {
+		ServeJSON(writer, http.StatusConflict, comm.ResponseData{
+			Err: conflict.Error(),
+		})
+		return
+	}
+	if cycle, ok := err.(*DeadLetterCycleError); ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: cycle.Error(),
+		})
+		return
+	}
+	if err == nil {
+		err = dest.checkOwner(v.ConsumerId)
+		if err != nil {
+			ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+				Err: err.Error(),
+			})
+			return
+		}
+		_, err = dest.Join(v.Group, v.ConsumerId)
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
 	ServeJSON(writer, http.StatusOK, comm.ResponseData{
-		Msg: "registry success",
+		Msg:  "registry success",
+		Data: RegistryResp{Options: dest.Options(), Created: created},
 	})
 }
 
@@ -53,23 +121,110 @@ var Consume http.HandlerFunc = func(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
-	queue, ok := ConsumeQueueMap.Get(v.DestName)
-	if !ok {
+	group, err := lookupConsumerGroup(v.DestName, v.Group, v.ConsumerId)
+	if err != nil {
 		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
-			Err: fmt.Sprintf("consume a unknown dest name %s", v.DestName),
+			Err: fmt.Sprintf("consume a unknown dest name or group, %v", err),
 		})
 		return
 	}
 
+	visibility := defaultVisibilityTimeout
+	if v.VisibilityTimeout > 0 {
+		visibility = time.Duration(v.VisibilityTimeout) * time.Second
+	}
+	ctx := request.Context()
+	if v.WaitSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(v.WaitSeconds)*time.Second)
+		defer cancel()
+	}
+	d := group.Get(ctx, v.ConsumerId, v.Prefetch, visibility)
+	if d == nil {
+		if request.Context().Err() != nil {
+			logrus.WithField("destName", v.DestName).Infof("consumer gone before any message arrived")
+			return
+		}
+		ServeJSON(writer, http.StatusOK, comm.ResponseData{
+			Msg:  "no message arrived before wait timeout",
+			Data: ConsumeResp{TimedOut: true},
+		})
+		return
+	}
 	err = ServeJSON(writer, http.StatusOK, comm.ResponseData{
 		Msg:  "consume msg success",
-		Data: ConsumeResp{Msg: queue.Get()},
+		Data: newConsumeResp(d),
+	})
+	if err != nil {
+		// 消息没有送达消费者，立即释放以便重新投递
+		group.Nack(d.Id, d.Lease, fmt.Sprintf("failed to write consume response, %v", err))
+	}
+}
+
+// 消费者确认消息已处理
+var Ack http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept ack request")
+	defer request.Body.Close()
+	v := new(AckReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	group, err := lookupGroup(v.DestName, v.Group)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("ack msg of a unknown dest name or group, %v", err),
+		})
+		return
+	}
+	err = group.Ack(v.Id, v.Lease)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "ack msg success",
 	})
+}
+
+// 消费者释放消息，消息会被重新投递
+var Nack http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept nack request")
+	defer request.Body.Close()
+	v := new(NackReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	group, err := lookupGroup(v.DestName, v.Group)
 	if err != nil {
-		queue.Done()
-	} else {
-		queue.Forget()
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("nack msg of a unknown dest name or group, %v", err),
+		})
+		return
 	}
+	err = group.Nack(v.Id, v.Lease, v.Error)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "nack msg success",
+	})
 }
 
 // 生产者生产函数
@@ -85,14 +240,27 @@ var Product http.HandlerFunc = func(writer http.ResponseWriter, request *http.Re
 		return
 	}
 
-	queue, ok := ConsumeQueueMap.Get(v.DestName)
+	dest, ok, err := productDest(v.DestName)
 	if !ok {
 		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
 			Err: fmt.Sprintf("product msg to a unknown dest name %s", v.DestName),
 		})
 		return
 	}
-	err = queue.Put(v.Msg)
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	m, err := v.message(time.Now(), dest.Options())
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	resp, err := dest.Put(request.Context(), m)
 	if err != nil {
 		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
 			Err: err.Error(),
@@ -101,10 +269,63 @@ var Product http.HandlerFunc = func(writer http.ResponseWriter, request *http.Re
 	}
 
 	ServeJSON(writer, http.StatusOK, comm.ResponseData{
-		Msg: "product msg success",
+		Msg:  "product msg success",
+		Data: resp,
 	})
 }
 
+// message 校验请求并构造待写入 destination 的消息
+func (v *ProductReq) message(now time.Time, opts DestOptions) (message, error) {
+	payload, err := newPayload(v.Msg, v.Body, v.ContentType, v.Headers)
+	if err != nil {
+		return message{}, err
+	}
+	payload.ReplyTo = v.ReplyTo
+	payload.CorrelationId = v.CorrelationId
+	deliverAt, err := v.deliverAt(now)
+	if err != nil {
+		return message{}, err
+	}
+	if v.TTLSeconds < 0 {
+		return message{}, fmt.Errorf("ttlSeconds can not be negative")
+	}
+	if v.Priority < 0 || v.Priority > opts.MaxPriority {
+		return message{}, fmt.Errorf("priority must be in [0, %d] for dest name %s", opts.MaxPriority, v.DestName)
+	}
+	return message{
+		Payload:      payload,
+		DeliverAt:    deliverAt,
+		ExpireAt:     expireAt(now, deliverAt, v.TTLSeconds),
+		Priority:     v.Priority,
+		DedupKey:     v.dedupKey(),
+		PartitionKey: v.PartitionKey,
+	}, nil
+}
+
+// deliverAt 计算延迟消息的投递时间，非延迟消息返回 nil
+func (v *ProductReq) deliverAt(now time.Time) (*time.Time, error) {
+	if v.DelaySeconds < 0 {
+		return nil, fmt.Errorf("delaySeconds can not be negative")
+	}
+	if v.DelaySeconds > 0 && v.DeliverAt != nil {
+		return nil, fmt.Errorf("deliverAt and delaySeconds can not be set at the same time")
+	}
+	if v.DelaySeconds > 0 {
+		deliverAt := now.Add(time.Duration(v.DelaySeconds) * time.Second)
+		return &deliverAt, nil
+	}
+	return v.DeliverAt, nil
+}
+
+// lookupGroup 返回 destName 下的消费组
+func lookupGroup(destName, group string) (*Group, error) {
+	dest, ok := DestinationMap.Get(destName)
+	if !ok {
+		return nil, fmt.Errorf("unknown dest name %s", destName)
+	}
+	return dest.Group(group)
+}
+
 // ServeJSON ...
 func ServeJSON(write http.ResponseWriter, code int, data comm.ResponseData) error {
 	write.Header().Set("Content-Type", "application/json; charset=utf-8")
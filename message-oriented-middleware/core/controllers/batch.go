@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxBatchSize 一次批量请求最多包含的消息数
+	maxBatchSize     = 1000
+	defaultBatchSize = 10
+)
+
+// ProductBatch 批量生产消息
+var ProductBatch http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	logrus.Infof("accept product batch request")
+	v := new(ProductBatchReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if len(v.Messages) == 0 || len(v.Messages) > maxBatchSize {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("batch size must be in [1, %d]", maxBatchSize),
+		})
+		return
+	}
+
+	dest, ok, err := productDest(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("product msg to a unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	opts := dest.Options()
+	ms := make([]message, len(v.Messages))
+	errs := make([]error, len(v.Messages))
+	for i := range v.Messages {
+		item := &v.Messages[i]
+		if item.DestName != "" && item.DestName != v.DestName {
+			errs[i] = fmt.Errorf("dest name %s of message does not match batch dest name %s", item.DestName, v.DestName)
+			continue
+		}
+		item.DestName = v.DestName
+		ms[i], errs[i] = item.message(now, opts)
+	}
+
+	if v.Atomic {
+		for i, err := range errs {
+			if err != nil {
+				ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+					Err: fmt.Sprintf("invalid message %d, %v", i, err),
+				})
+				return
+			}
+		}
+		resps, err := dest.PutBatch(request.Context(), ms)
+		if err != nil {
+			ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+				Err: err.Error(),
+			})
+			return
+		}
+		resp := ProductBatchResp{Results: make([]ProductBatchResult, len(resps))}
+		for i, r := range resps {
+			resp.Results[i] = ProductBatchResult{Id: r.Id, Duplicate: r.Duplicate}
+		}
+		ServeJSON(writer, http.StatusOK, comm.ResponseData{
+			Msg:  "product msg batch success",
+			Data: resp,
+		})
+		return
+	}
+
+	resp := ProductBatchResp{Results: make([]ProductBatchResult, len(ms))}
+	for i, m := range ms {
+		err := errs[i]
+		if err == nil {
+			var r ProductResp
+			r, err = dest.Put(request.Context(), m)
+			resp.Results[i] = ProductBatchResult{Id: r.Id, Duplicate: r.Duplicate}
+		}
+		if err != nil {
+			resp.Results[i].Err = err.Error()
+		}
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "product msg batch finished",
+		Data: resp,
+	})
+}
+
+// ConsumeBatch 批量消费消息，每条消息都需要单独确认
+var ConsumeBatch http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept consume batch request")
+	defer request.Body.Close()
+	v := new(ConsumeBatchReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.Max < 0 || v.Max > maxBatchSize {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("max must be in [0, %d]", maxBatchSize),
+		})
+		return
+	}
+	max := v.Max
+	if max == 0 {
+		max = defaultBatchSize
+	}
+
+	group, err := lookupConsumerGroup(v.DestName, v.Group, v.ConsumerId)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("consume a unknown dest name or group, %v", err),
+		})
+		return
+	}
+
+	visibility := defaultVisibilityTimeout
+	if v.VisibilityTimeout > 0 {
+		visibility = time.Duration(v.VisibilityTimeout) * time.Second
+	}
+	ctx := request.Context()
+	if v.WaitSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(v.WaitSeconds)*time.Second)
+		defer cancel()
+	}
+	ds := group.GetBatch(ctx, v.ConsumerId, v.Prefetch, visibility, max)
+	if len(ds) == 0 {
+		if request.Context().Err() != nil {
+			logrus.WithField("destName", v.DestName).Infof("consumer gone before any message arrived")
+			return
+		}
+		ServeJSON(writer, http.StatusOK, comm.ResponseData{
+			Msg:  "no message arrived before wait timeout",
+			Data: ConsumeBatchResp{TimedOut: true},
+		})
+		return
+	}
+
+	resp := ConsumeBatchResp{Messages: make([]ConsumeResp, len(ds))}
+	for i, d := range ds {
+		resp.Messages[i] = newConsumeResp(d)
+	}
+	err = ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "consume msg batch success",
+		Data: resp,
+	})
+	if err != nil {
+		// 消息没有送达消费者，立即释放以便重新投递
+		for _, d := range ds {
+			group.Nack(d.Id, d.Lease, fmt.Sprintf("failed to write consume response, %v", err))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPutBatchRejectsDropNewestOverflow(t *testing.T) {
+	dest := newTestDest(t, "batch-drop-newest", DestOptions{Capacity: 2, OverflowPolicy: OverflowDropNewest})
+	q := queueOf(t, dest, DefaultGroup, 0)
+	if _, err := dest.Put(context.Background(), textMessages("single", 1)[0]); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// 队列只剩一个空位，原子批量写入不能只写入其中的一部分或全部丢弃后仍返回成功
+	if _, err := dest.PutBatch(context.Background(), textMessages("batch", 2)); err == nil {
+		t.Fatal("atomic batch into a full drop-newest queue succeeded, want error")
+	}
+	if n := queueSize(q); n != 1 {
+		t.Fatalf("queue size after rejected batch = %d, want 1", n)
+	}
+
+	// 能够完整写入时照常写入
+	if _, err := dest.PutBatch(context.Background(), textMessages("fit", 1)); err != nil {
+		t.Fatalf("atomic batch that fits: %v", err)
+	}
+	if n := queueSize(q); n != 2 {
+		t.Fatalf("queue size after batch = %d, want 2", n)
+	}
+
+	// 单条写入仍按 drop-newest 策略静默丢弃
+	if _, err := dest.Put(context.Background(), textMessages("dropped", 1)[0]); err != nil {
+		t.Fatalf("put into full drop-newest queue: %v", err)
+	}
+	if n := queueSize(q); n != 2 {
+		t.Fatalf("queue size after dropped put = %d, want 2", n)
+	}
+}
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"technology/message-oriented-middleware/core/wal"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQueueCap = 10
+	groupsDirName   = "groups"
+	metaFileName    = "meta.json"
+	topicsFileName  = "topics.json"
+	partitionPrefix = "partition-"
+
+	defaultSweepInterval = 100 * time.Millisecond
+)
+
+var (
+	brokerOptions Options
+)
+
+// Options broker 的全局配置
+type Options struct {
+	// DataDir 消息持久化目录，为空时消息只保存在内存中
+	DataDir string
+	WAL     wal.Options
+	// Templates destination 的配置模板，见 Config
+	Templates []DestTemplate
+}
+
+// Init 应用 broker 配置，并从 DataDir 中恢复重启前的 destination、各消费组尚未被消费的消息、
+// topic 订阅关系、stream 以及 exchange 的绑定
+func Init(opts Options) error {
+	if err := opts.WAL.Validate(); err != nil {
+		return err
+	}
+	if err := validateTemplates(opts.Templates); err != nil {
+		return err
+	}
+	brokerOptions = opts
+	if opts.DataDir != "" {
+		err := restoreDestinations()
+		if err != nil {
+			return err
+		}
+		err = restoreTopics()
+		if err != nil {
+			return err
+		}
+		err = restoreStreams()
+		if err != nil {
+			return err
+		}
+		err = restoreExchanges()
+		if err != nil {
+			return err
+		}
+	}
+	startSweeper(defaultSweepInterval)
+	return nil
+}
+
+func restoreDestinations() error {
+	infos, err := ioutil.ReadDir(brokerOptions.DataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() || info.Name() == streamsDirName {
+			continue
+		}
+		destName, err := decodeDirName(info.Name())
+		if err != nil {
+			logrus.WithField("dir", info.Name()).Warnf("skip unknown dir in data dir")
+			continue
+		}
+		opts := DestOptions{}
+		err = loadJSON(filepath.Join(queueDir(destName), metaFileName), &opts)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dest, err := DestinationMap.GetOrAdd(destName, opts)
+		if err != nil {
+			return err
+		}
+
+		groupInfos, err := ioutil.ReadDir(filepath.Join(queueDir(destName), groupsDirName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, groupInfo := range groupInfos {
+			group, err := decodeDirName(groupInfo.Name())
+			if err != nil || !groupInfo.IsDir() {
+				continue
+			}
+			_, err = dest.Join(group, "")
+			if err != nil {
+				return err
+			}
+			logrus.WithField("destName", destName).WithField("group", group).
+				Infof("success restore group queue")
+		}
+	}
+	return nil
+}
+
+func restoreTopics() error {
+	topics := make(map[string][]string)
+	err := loadJSON(filepath.Join(brokerOptions.DataDir, topicsFileName), &topics)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	TopicMap.restore(topics)
+	return nil
+}
+
+func restoreStreams() error {
+	infos, err := ioutil.ReadDir(filepath.Join(brokerOptions.DataDir, streamsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		name, err := decodeDirName(info.Name())
+		if err != nil || !info.IsDir() {
+			logrus.WithField("dir", info.Name()).Warnf("skip unknown dir in streams dir")
+			continue
+		}
+		opts := StreamOptions{}
+		err = loadJSON(filepath.Join(streamDir(name), metaFileName), &opts)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s, err := openStream(name, opts)
+		if err != nil {
+			return err
+		}
+		StreamMap.streams[name] = s
+		logrus.WithField("stream", name).WithField("startOffset", s.start).WithField("endOffset", s.end).
+			Infof("success restore stream")
+	}
+	return nil
+}
+
+// newGroupQueue 按 destination 的配置创建消费组第 partition 个分区的队列，
+// persistent 为 true 且配置了 DataDir 时队列由预写日志持久化
+func newGroupQueue(destName, group string, partition int, opts DestOptions, persistent bool) (*Queue, error) {
+	q := NewPriorityQueue(opts.Capacity, opts.MaxPriority, time.Duration(opts.StarvationSeconds)*time.Second)
+	q.destName = destName
+	q.maxBytes = opts.MaxBytes
+	q.maxDeliveries = opts.MaxDeliveries
+	q.deadLetterExpired = opts.deadLetterExpired()
+	if !persistent || brokerOptions.DataDir == "" {
+		return q, nil
+	}
+	err := q.restore(partitionDir(destName, group, partition), brokerOptions.WAL)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// groupDir 返回消费组对应的持久化目录
+func groupDir(destName, group string) string {
+	return filepath.Join(queueDir(destName), groupsDirName, encodeDirName(group))
+}
+
+// partitionDir 返回消费组分区对应的持久化目录，第 0 个分区直接使用消费组的目录，与未分区时的目录兼容
+func partitionDir(destName, group string, partition int) string {
+	dir := groupDir(destName, group)
+	if partition == 0 {
+		return dir
+	}
+	return filepath.Join(dir, partitionPrefix+strconv.Itoa(partition))
+}
+
+// streamDir 返回 stream 对应的持久化目录
+func streamDir(name string) string {
+	return filepath.Join(brokerOptions.DataDir, streamsDirName, encodeDirName(name))
+}
+
+// queueDir 返回 destName 对应的持久化目录，目录名使用 base64 编码避免特殊字符
+func queueDir(destName string) string {
+	return filepath.Join(brokerOptions.DataDir, encodeDirName(destName))
+}
+
+func encodeDirName(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeDirName(dirName string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(dirName)
+	return string(name), err
+}
+
+// saveMeta 在配置了 DataDir 时将元数据以 json 格式写入 DataDir 下的 path
+func saveMeta(path string, v interface{}) error {
+	if brokerOptions.DataDir == "" {
+		return nil
+	}
+	return saveJSON(filepath.Join(brokerOptions.DataDir, path), v)
+}
+
+// saveJSON 先写入临时文件再重命名，避免写入过程中崩溃留下不完整的文件
+func saveJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
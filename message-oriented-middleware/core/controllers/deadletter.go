@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DeadLetterInfo 死信消息的元数据
+type DeadLetterInfo struct {
+	OriginalDest  string    `json:"originalDest,omitempty"`
+	OriginalGroup string    `json:"originalGroup,omitempty"`
+	Failures      int       `json:"failures,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	DeadAt        time.Time `json:"deadAt,omitempty"`
+}
+
+// deadLetter 将消费组 group 中投递失败次数达到上限或过期的消息转入死信 destination
+func (d *Destination) deadLetter(group string, m *message) error {
+	if d.opts.DeadLetterDest == "" {
+		logrus.WithField("destName", d.name).WithField("group", group).WithField("id", m.Id).
+			Warnf("drop dead letter message, last error = %s", m.lastError)
+		return nil
+	}
+	dlq, err := DestinationMap.GetOrAdd(d.opts.DeadLetterDest, templateOptions(d.opts.DeadLetterDest, DestOptions{}))
+	if err != nil {
+		return err
+	}
+	err = dlq.ensureGroup()
+	if err != nil {
+		return err
+	}
+	logrus.WithField("destName", d.name).WithField("group", group).WithField("id", m.Id).
+		WithField("deadLetterDest", d.opts.DeadLetterDest).Warnf("move message to dead letter dest")
+	return dlq.putMessage(message{
+		Id:           m.Id,
+		Payload:      m.Payload,
+		Priority:     m.Priority,
+		PartitionKey: m.PartitionKey,
+		DeadLetter: &DeadLetterInfo{
+			OriginalDest:  d.name,
+			OriginalGroup: group,
+			Failures:      m.Failures,
+			LastError:     m.lastError,
+			DeadAt:        time.Now(),
+		},
+	})
+}
+
+// ensureGroup destination 没有消费组时创建默认消费组
+func (d *Destination) ensureGroup() error {
+	d.mutex.RLock()
+	n := len(d.groups)
+	d.mutex.RUnlock()
+	if n > 0 {
+		return nil
+	}
+	_, err := d.Join(DefaultGroup, "")
+	return err
+}
+
+// Redrive 将死信 destination 中消费组 group 的消息送回其原始的 destination 与消费组，
+// 最多处理 max 条，max 为 0 时处理所有消息。无法送回的消息保留在死信 destination 中
+func (d *Destination) Redrive(group string, max int) (*RedriveResp, error) {
+	g, err := d.Group(group)
+	if err != nil {
+		return nil, err
+	}
+	resp := &RedriveResp{}
+	for _, q := range g.partitions {
+		redriveQueue(q, resp, max)
+	}
+	return resp, nil
+}
+
+// redriveQueue 将队列中的死信消息送回原始的 destination，resp 中累计处理的消息数达到 max 时停止
+func redriveQueue(q *Queue, resp *RedriveResp, max int) {
+	var skipped []*message
+	defer func() {
+		for i := len(skipped) - 1; i >= 0; i-- {
+			q.pushFront(skipped[i])
+		}
+	}()
+
+	for max <= 0 || resp.Redriven+resp.Failed < max {
+		m := q.popFront()
+		if m == nil {
+			break
+		}
+		if m.DeadLetter == nil {
+			skipped = append(skipped, m)
+			resp.Failed++
+			continue
+		}
+		err := redrive(m)
+		if err != nil {
+			logrus.WithField("id", m.Id).WithField("originalDest", m.DeadLetter.OriginalDest).
+				Errorf("failed to redrive dead letter message, error = %v", err)
+			skipped = append(skipped, m)
+			resp.Failed++
+			continue
+		}
+		q.ackRemoved(m)
+		resp.Redriven++
+	}
+}
+
+func redrive(m *message) error {
+	dest, ok := DestinationMap.Get(m.DeadLetter.OriginalDest)
+	if !ok {
+		return fmt.Errorf("unknown original dest name %s", m.DeadLetter.OriginalDest)
+	}
+	return dest.putToGroup(m.DeadLetter.OriginalGroup, message{
+		Id:           m.Id,
+		Payload:      m.Payload,
+		Priority:     m.Priority,
+		PartitionKey: m.PartitionKey,
+	})
+}
+
+// 将死信消息送回原始的 destination
+var RedriveDeadLetter http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept redrive dead letter request")
+	defer request.Body.Close()
+	v := new(RedriveReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	dest, ok := DestinationMap.Get(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("redrive a unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	resp, err := dest.Redrive(v.Group, v.Max)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "redrive dead letter success",
+		Data: resp,
+	})
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+)
+
+// register 注册 destination 并创建默认消费组，测试结束时删除
+func register(t *testing.T, name string, opts DestOptions) (*Destination, error) {
+	dest, _, err := DestinationMap.Register(name, opts, false)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		DestinationMap.Delete(name)
+	})
+	if _, err := dest.Join(DefaultGroup, ""); err != nil {
+		t.Fatalf("join default group: %v", err)
+	}
+	return dest, nil
+}
+
+func TestRegisterRejectsDeadLetterCycle(t *testing.T) {
+	if _, err := register(t, "cycle-a", DestOptions{DeadLetterDest: "cycle-b"}); err != nil {
+		t.Fatalf("register cycle-a: %v", err)
+	}
+	if _, err := register(t, "cycle-b", DestOptions{DeadLetterDest: "cycle-a"}); err == nil {
+		t.Fatal("register cycle-b -> cycle-a -> cycle-b succeeded, want DeadLetterCycleError")
+	} else if _, ok := err.(*DeadLetterCycleError); !ok {
+		t.Fatalf("register cycle-b returned %v, want DeadLetterCycleError", err)
+	}
+
+	// 链上的死信 destination 不回到自身时可以注册
+	if _, err := register(t, "cycle-b", DestOptions{DeadLetterDest: "cycle-c"}); err != nil {
+		t.Fatalf("register cycle-b -> cycle-c: %v", err)
+	}
+	if _, err := register(t, "cycle-c", DestOptions{DeadLetterDest: "cycle-a"}); err == nil {
+		t.Fatal("register cycle-c -> cycle-a -> cycle-b -> cycle-c succeeded, want DeadLetterCycleError")
+	}
+	if _, err := register(t, "cycle-d", DestOptions{DeadLetterDest: "cycle-a"}); err != nil {
+		t.Fatalf("register cycle-d -> cycle-a: %v", err)
+	}
+}
+
+func TestRegisterRejectsDeadLetterCycleThroughTemplate(t *testing.T) {
+	// 尚不存在的死信 destination 转入死信时按模板自动创建，其死信 destination 同样参与检查
+	withTemplates(t, []DestTemplate{{Pattern: "dlq.*", Options: DestOptions{DeadLetterDest: "tpl-cycle"}}})
+	if _, err := register(t, "tpl-cycle", DestOptions{DeadLetterDest: "dlq.tpl-cycle"}); err == nil {
+		t.Fatal("register tpl-cycle -> dlq.tpl-cycle -> tpl-cycle succeeded, want DeadLetterCycleError")
+	}
+}
+
+func TestRedriveReleasesDeadLetterCapacity(t *testing.T) {
+	src, err := register(t, "redrive-src", DestOptions{DeadLetterDest: "redrive-dlq"})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	dlq, err := register(t, "redrive-dlq", DestOptions{Capacity: 1})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	m := textMessages("dead", 1)[0]
+	m.Id = "dead-0"
+	if err := src.deadLetter(DefaultGroup, &m); err != nil {
+		t.Fatalf("dead letter: %v", err)
+	}
+	q := queueOf(t, dlq, DefaultGroup, 0)
+
+	// 送回过程中取出的消息仍占用死信队列的容量
+	popped := q.popFront()
+	if popped == nil {
+		t.Fatal("no message in dead letter queue")
+	}
+	if _, err := dlq.Put(context.Background(), textMessages("extra", 1)[0]); err == nil {
+		t.Fatal("put into dead letter queue while redriving its only message succeeded, want full error")
+	}
+	q.pushFront(popped)
+
+	resp, err := dlq.Redrive(DefaultGroup, 0)
+	if err != nil {
+		t.Fatalf("redrive: %v", err)
+	}
+	if resp.Redriven != 1 || resp.Failed != 0 {
+		t.Fatalf("redrive result = %+v, want 1 redriven", resp)
+	}
+	if n := queueSize(q); n != 0 {
+		t.Fatalf("dead letter queue size after redrive = %d, want 0", n)
+	}
+	if n := queueSize(queueOf(t, src, DefaultGroup, 0)); n != 1 {
+		t.Fatalf("source queue size after redrive = %d, want 1", n)
+	}
+	if _, err := dlq.Put(context.Background(), textMessages("extra", 1)[0]); err != nil {
+		t.Fatalf("put into dead letter queue after redrive: %v", err)
+	}
+}
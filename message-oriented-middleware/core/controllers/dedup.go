@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindowSeconds = 300
+	defaultDedupMaxEntries    = 10000
+)
+
+// dedupCache 记录最近生产的带有幂等键的消息，窗口内重复的消息直接返回原消息的 id。
+// 超出窗口时长或条目数上限的记录按写入顺序淘汰。正在写入的消息先预留幂等键，
+// 写入成功后才记录，预留期间使用相同幂等键的生产者等待写入结束
+type dedupCache struct {
+	sync.Mutex
+	window     time.Duration
+	maxEntries int
+	order      list.List
+	entries    map[string]*list.Element
+	// reserved 正在写入的消息的幂等键，写入结束时关闭对应的 channel
+	reserved map[string]chan struct{}
+}
+
+type dedupEntry struct {
+	key string
+	id  string
+	at  time.Time
+}
+
+func newDedupCache(window time.Duration, maxEntries int) *dedupCache {
+	return &dedupCache{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		reserved:   make(map[string]chan struct{}),
+	}
+}
+
+// get 返回窗口内 key 对应的消息 id，调用方需持有锁
+func (c *dedupCache) get(key string, now time.Time) (string, bool) {
+	c.evict(now)
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	return e.Value.(*dedupEntry).id, true
+}
+
+// add 记录 key 对应的消息 id，key 已存在时保留原记录，调用方需持有锁
+func (c *dedupCache) add(key, id string, at time.Time) {
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushBack(&dedupEntry{key: key, id: id, at: at})
+	c.evict(at)
+}
+
+// reserve 预留 key，key 已被预留时返回预留结束时关闭的 channel，调用方需持有锁
+func (c *dedupCache) reserve(key string) (<-chan struct{}, bool) {
+	if done, ok := c.reserved[key]; ok {
+		return done, false
+	}
+	c.reserved[key] = make(chan struct{})
+	return nil, true
+}
+
+// release 结束 key 的预留，stored 为 true 时记录 key 对应的消息 id，调用方需持有锁
+func (c *dedupCache) release(key, id string, stored bool, at time.Time) {
+	if stored {
+		c.add(key, id, at)
+	}
+	close(c.reserved[key])
+	delete(c.reserved, key)
+}
+
+func (c *dedupCache) evict(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if c.order.Len() <= c.maxEntries && now.Sub(entry.at) < c.window {
+			return
+		}
+		c.order.Remove(e)
+		delete(c.entries, entry.key)
+	}
+}
+
+// dedupKey 返回生产请求的幂等键，未指定时返回空字符串
+func (v *ProductReq) dedupKey() string {
+	if v.IdempotencyKey != "" {
+		return "key/" + v.IdempotencyKey
+	}
+	if v.ProducerId != "" {
+		return fmt.Sprintf("producer/%s/%d", v.ProducerId, v.Seq)
+	}
+	return ""
+}
+
+// seedDedup 使用队列中恢复的消息重建幂等记录，已被消费的消息无法恢复，重启后仍可能产生重复的消息
+func (d *Destination) seedDedup(q *Queue) {
+	d.dedup.Lock()
+	defer d.dedup.Unlock()
+	q.Lock()
+	defer q.Unlock()
+	seed := func(m *message) {
+		if m.DedupKey != "" && !m.CreatedAt.IsZero() {
+			d.dedup.add(m.DedupKey, m.Id, m.CreatedAt)
+		}
+	}
+	q.ready.Range(seed)
+	for _, m := range q.scheduled {
+		seed(m)
+	}
+}
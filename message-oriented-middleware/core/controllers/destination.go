@@ -0,0 +1,440 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultGroup 未指定消费组时使用的消费组
+	DefaultGroup = "default"
+)
+
+// Destination 消息的目的地，每个消费组拥有独立的队列，
+// 生产的消息会复制到所有消费组，同一消费组内的消费者竞争消费
+type Destination struct {
+	mutex  sync.RWMutex
+	name   string
+	opts   DestOptions
+	groups map[string]*Group
+	dedup  *dedupCache
+	// nextPartition 没有分区键的消息轮流写入各个分区
+	nextPartition uint64
+	// owner 临时 destination 的所有者，创建后不再修改，普通 destination 为空
+	owner string
+}
+
+// DestOptions destination 的配置，创建时持久化到 destination 目录下的 meta.json 中
+type DestOptions struct {
+	// Capacity 每个消费组队列的容量，分区模式下为每个分区的容量
+	Capacity int `json:"capacity,omitempty"`
+	// MaxDeliveries 消息投递失败的最大次数，达到后消息转入 DeadLetterDest，为 0 时不限制
+	MaxDeliveries int `json:"maxDeliveries,omitempty"`
+	// DeadLetterDest 死信 destination，为空时失败次数达到上限的消息会被丢弃
+	DeadLetterDest string `json:"deadLetterDest,omitempty"`
+	// TTLSeconds 消息默认的存活时间，单位秒，为 0 时消息不过期
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// DeadLetterExpired 为 true 时过期的消息转入 DeadLetterDest，否则直接丢弃，为 nil 时表示未指定
+	DeadLetterExpired *bool `json:"deadLetterExpired,omitempty"`
+	// MaxPriority 大于 0 时开启优先级模式，消息优先级的取值范围为 0 到 MaxPriority
+	MaxPriority int `json:"maxPriority,omitempty"`
+	// StarvationSeconds 大于 0 时开启防饥饿，低优先级消息等待超过该秒数后优先投递
+	StarvationSeconds int `json:"starvationSeconds,omitempty"`
+	// MaxBytes 每个消费组队列中消息内容的总字节数上限，为 0 时不限制
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// OverflowPolicy 队列已满时的处理策略，见 OverflowReject 等常量
+	OverflowPolicy string `json:"overflowPolicy,omitempty"`
+	// BlockTimeoutSeconds OverflowBlock 策略下生产者最多等待的秒数
+	BlockTimeoutSeconds int `json:"blockTimeoutSeconds,omitempty"`
+	// DedupWindowSeconds 带有幂等键的消息的去重窗口，单位秒
+	DedupWindowSeconds int `json:"dedupWindowSeconds,omitempty"`
+	// DedupMaxEntries 去重窗口内最多记录的幂等键数
+	DedupMaxEntries int `json:"dedupMaxEntries,omitempty"`
+	// Partitions 每个消费组的分区数，大于 1 时开启分区模式，创建后不能修改
+	Partitions int `json:"partitions,omitempty"`
+}
+
+func (o DestOptions) withDefaults() DestOptions {
+	if o.Capacity <= 0 {
+		o.Capacity = defaultQueueCap
+	}
+	if o.OverflowPolicy == "" {
+		o.OverflowPolicy = OverflowReject
+	}
+	if o.OverflowPolicy == OverflowBlock && o.BlockTimeoutSeconds <= 0 {
+		o.BlockTimeoutSeconds = defaultBlockTimeoutSeconds
+	}
+	if o.DedupWindowSeconds <= 0 {
+		o.DedupWindowSeconds = defaultDedupWindowSeconds
+	}
+	if o.DedupMaxEntries <= 0 {
+		o.DedupMaxEntries = defaultDedupMaxEntries
+	}
+	if o.Partitions <= 0 {
+		o.Partitions = 1
+	}
+	if o.DeadLetterExpired == nil {
+		o.DeadLetterExpired = newBool(false)
+	}
+	return o
+}
+
+// deadLetterExpired 返回 DeadLetterExpired 的值，未指定时为 false
+func (o DestOptions) deadLetterExpired() bool {
+	return o.DeadLetterExpired != nil && *o.DeadLetterExpired
+}
+
+func newBool(b bool) *bool {
+	return &b
+}
+
+// conflicts 返回与 current 不一致的配置项，未指定的配置不参与比较
+func (o DestOptions) conflicts(current DestOptions) []string {
+	var fields []string
+	check := func(name string, specified, equal bool) {
+		if specified && !equal {
+			fields = append(fields, name)
+		}
+	}
+	check("capacity", o.Capacity != 0, o.Capacity == current.Capacity)
+	check("maxDeliveries", o.MaxDeliveries != 0, o.MaxDeliveries == current.MaxDeliveries)
+	check("deadLetterDest", o.DeadLetterDest != "", o.DeadLetterDest == current.DeadLetterDest)
+	check("ttlSeconds", o.TTLSeconds != 0, o.TTLSeconds == current.TTLSeconds)
+	check("deadLetterExpired", o.DeadLetterExpired != nil, o.deadLetterExpired() == current.deadLetterExpired())
+	check("maxPriority", o.MaxPriority != 0, o.MaxPriority == current.MaxPriority)
+	check("starvationSeconds", o.StarvationSeconds != 0, o.StarvationSeconds == current.StarvationSeconds)
+	check("maxBytes", o.MaxBytes != 0, o.MaxBytes == current.MaxBytes)
+	check("overflowPolicy", o.OverflowPolicy != "", o.OverflowPolicy == current.OverflowPolicy)
+	check("blockTimeoutSeconds", o.BlockTimeoutSeconds != 0, o.BlockTimeoutSeconds == current.BlockTimeoutSeconds)
+	check("dedupWindowSeconds", o.DedupWindowSeconds != 0, o.DedupWindowSeconds == current.DedupWindowSeconds)
+	check("dedupMaxEntries", o.DedupMaxEntries != 0, o.DedupMaxEntries == current.DedupMaxEntries)
+	check("partitions", o.Partitions != 0, o.Partitions == current.Partitions)
+	return fields
+}
+
+// OptionsConflictError 重复注册 destination 时指定的配置与已有的配置不一致
+type OptionsConflictError struct {
+	DestName string
+	Fields   []string
+}
+
+func (e *OptionsConflictError) Error() string {
+	return fmt.Sprintf("dest name %s already exists with different %s, use force to recreate it and discard all its messages",
+		e.DestName, strings.Join(e.Fields, ", "))
+}
+
+// validate 校验注册时指定的配置，未指定的配置使用默认值
+func (o DestOptions) validate() error {
+	if o.Capacity < 0 || o.MaxBytes < 0 {
+		return fmt.Errorf("capacity and maxBytes can not be negative")
+	}
+	if o.DedupWindowSeconds < 0 || o.DedupMaxEntries < 0 {
+		return fmt.Errorf("dedupWindowSeconds and dedupMaxEntries can not be negative")
+	}
+	if o.Partitions < 0 || o.Partitions > maxPartitions {
+		return fmt.Errorf("partitions must be in [0, %d]", maxPartitions)
+	}
+	if o.MaxPriority < 0 || o.MaxPriority > maxPriorityLimit || o.StarvationSeconds < 0 {
+		return fmt.Errorf("maxPriority must be in [0, %d] and starvationSeconds can not be negative", maxPriorityLimit)
+	}
+	switch o.OverflowPolicy {
+	case "", OverflowReject, OverflowDropOldest, OverflowDropNewest:
+		if o.BlockTimeoutSeconds != 0 {
+			return fmt.Errorf("blockTimeoutSeconds can only be set with overflow policy %s", OverflowBlock)
+		}
+	case OverflowBlock:
+		if o.BlockTimeoutSeconds < 0 {
+			return fmt.Errorf("blockTimeoutSeconds can not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy %s, must be one of %s, %s, %s, %s",
+			o.OverflowPolicy, OverflowReject, OverflowDropOldest, OverflowDropNewest, OverflowBlock)
+	}
+	return nil
+}
+
+// Group 消费组，记录组内的消费者及其最近一次活跃时间。
+// 消费组的消息按分区保存在多个队列中，分区模式下每个分区同一时间只分配给一个消费者
+type Group struct {
+	mutex      sync.Mutex
+	name       string
+	partitions []*Queue
+	consumers  map[string]time.Time
+	// available 所有分区共用，任一分区有消息可以投递或消费者变化时通知
+	available *broadcast
+	// next 消费者依次从不同的分区开始取消息，避免总是优先消费同一个分区
+	next uint32
+}
+
+func NewDestination(name string, opts DestOptions) *Destination {
+	opts = opts.withDefaults()
+	return &Destination{
+		name:   name,
+		opts:   opts,
+		groups: make(map[string]*Group),
+		dedup:  newDedupCache(time.Duration(opts.DedupWindowSeconds)*time.Second, opts.DedupMaxEntries),
+	}
+}
+
+func groupName(group string) string {
+	if group == "" {
+		return DefaultGroup
+	}
+	return group
+}
+
+// Options 返回 destination 的配置
+func (d *Destination) Options() DestOptions {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.opts
+}
+
+// Join 将消费者加入消费组，消费组不存在时创建，新的消费组从加入之后生产的消息开始消费
+func (d *Destination) Join(group, consumerId string) (*Group, error) {
+	if err := d.checkOwner(consumerId); err != nil {
+		return nil, err
+	}
+	group = groupName(group)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	g, ok := d.groups[group]
+	if !ok {
+		var err error
+		g, err = d.newGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		d.groups[group] = g
+	}
+	g.touch(consumerId)
+	return g, nil
+}
+
+// Group 返回消费组
+func (d *Destination) Group(group string) (*Group, error) {
+	group = groupName(group)
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	g, ok := d.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %s of dest name %s", group, d.name)
+	}
+	return g, nil
+}
+
+// Put 为消息分配 id 并将其复制到所有消费组，所有消费组都有空间时才会写入，返回消息 id。
+// 消息未指定过期时间时使用 destination 默认的存活时间
+func (d *Destination) Put(ctx context.Context, m message) (ProductResp, error) {
+	resps, err := d.putBatch(ctx, []message{m}, false)
+	if err != nil {
+		return ProductResp{}, err
+	}
+	return resps[0], nil
+}
+
+// PutBatch 原子地写入一批消息，OverflowDropNewest 策略下有队列已满时拒绝整批消息，不会只写入其中的一部分
+func (d *Destination) PutBatch(ctx context.Context, ms []message) ([]ProductResp, error) {
+	return d.putBatch(ctx, ms, true)
+}
+
+// putBatch 与 Put 相同，所有消费组都能容纳全部消息时才会写入，返回消息 id。
+// OverflowBlock 策略下队列已满时等待空间，直到超时或 ctx 结束
+// 带有幂等键的消息在去重窗口内重复时不会写入，返回原消息的 id。
+// 只有实际写入的消息才会记录幂等键，在所有消费组中都被丢弃的消息重试时会再次写入。
+// atomic 为 true 时 OverflowDropNewest 策略下有队列已满则返回错误，不写入任何消息
+func (d *Destination) putBatch(ctx context.Context, ms []message, atomic bool) ([]ProductResp, error) {
+	now := time.Now()
+	resps := make([]ProductResp, len(ms))
+	keyed := false
+	for i := range ms {
+		ms[i].Id = uuid.New().String()
+		d.defaultExpireAt(&ms[i], now)
+		resps[i].Id = ms[i].Id
+		keyed = keyed || ms[i].DedupKey != ""
+	}
+	if !keyed {
+		_, err := d.storeMessages(ctx, ms, true, atomic)
+		if err != nil {
+			return nil, err
+		}
+		return resps, nil
+	}
+
+	fresh, err := d.reserveKeys(ctx, ms, resps, now)
+	if err != nil {
+		return nil, err
+	}
+	var stored []bool
+	if len(fresh) > 0 {
+		stored, err = d.storeMessages(ctx, fresh, true, atomic)
+	}
+	// 写入期间不持有锁，写入结束后只记录实际写入的消息的幂等键并释放预留，写入失败时生产者可以重试
+	d.dedup.Lock()
+	for i, m := range fresh {
+		if m.DedupKey != "" {
+			d.dedup.release(m.DedupKey, m.Id, err == nil && stored[i], now)
+		}
+	}
+	d.dedup.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
+
+// reserveKeys 预留消息的幂等键，返回需要写入的消息，重复的消息在 resps 中记录原消息的 id。
+// 幂等键正在被其他生产者写入时，释放已预留的幂等键并等待其写入结束后重新检查
+func (d *Destination) reserveKeys(ctx context.Context, ms []message, resps []ProductResp, now time.Time) ([]message, error) {
+	for {
+		d.dedup.Lock()
+		fresh := make([]message, 0, len(ms))
+		batchIds := make(map[string]string)
+		var busy <-chan struct{}
+		for i, m := range ms {
+			resps[i] = ProductResp{Id: m.Id}
+			if m.DedupKey == "" {
+				fresh = append(fresh, m)
+				continue
+			}
+			id, ok := d.dedup.get(m.DedupKey, now)
+			if !ok {
+				id, ok = batchIds[m.DedupKey]
+			}
+			if ok {
+				resps[i] = ProductResp{Id: id, Duplicate: true}
+				continue
+			}
+			done, ok := d.dedup.reserve(m.DedupKey)
+			if !ok {
+				busy = done
+				break
+			}
+			batchIds[m.DedupKey] = m.Id
+			fresh = append(fresh, m)
+		}
+		if busy == nil {
+			d.dedup.Unlock()
+			return fresh, nil
+		}
+		for _, m := range fresh {
+			if m.DedupKey != "" {
+				d.dedup.release(m.DedupKey, m.Id, false, now)
+			}
+		}
+		d.dedup.Unlock()
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// defaultExpireAt 未指定过期时间的消息使用 destination 默认的存活时间
+func (d *Destination) defaultExpireAt(m *message, now time.Time) {
+	if m.ExpireAt == nil {
+		m.ExpireAt = expireAt(now, m.DeliverAt, d.opts.TTLSeconds)
+	}
+}
+
+// putMessage 将消息复制到所有消费组，用于死信等 broker 内部的转发，队列已满时不会等待
+func (d *Destination) putMessage(m message) error {
+	return d.putMessages(context.Background(), []message{m}, false)
+}
+
+// putToGroup 将消息写入指定的消费组
+func (d *Destination) putToGroup(group string, m message) error {
+	g, err := d.Group(group)
+	if err != nil {
+		return err
+	}
+	d.mutex.RLock()
+	d.assignPartition(&m)
+	d.mutex.RUnlock()
+	q := g.partitions[m.partition]
+	q.Lock()
+	defer q.Unlock()
+	if !q.fits(1, int64(len(m.Body))) {
+		return fmt.Errorf("queue of group %s has been full", g.name)
+	}
+	return q.put(&m)
+}
+
+// Groups 返回所有消费组
+func (d *Destination) Groups() []*Group {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	groups := make([]*Group, 0, len(d.groups))
+	for _, g := range d.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// expireAt 计算消息的过期时间，延迟消息从投递时间开始计算，ttlSeconds 为 0 时返回 nil
+func expireAt(now time.Time, deliverAt *time.Time, ttlSeconds int) *time.Time {
+	if ttlSeconds <= 0 {
+		return nil
+	}
+	base := now
+	if deliverAt != nil && deliverAt.After(now) {
+		base = *deliverAt
+	}
+	t := base.Add(time.Duration(ttlSeconds) * time.Second)
+	return &t
+}
+
+// Close 关闭所有消费组的队列
+func (d *Destination) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var err error
+	for _, g := range d.groups {
+		for _, q := range g.partitions {
+			if cerr := q.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Remove 关闭所有消费组的队列并删除 destination 的持久化数据
+func (d *Destination) Remove() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for name, g := range d.groups {
+		// 其他分区的目录位于第 0 个分区的目录下，先删除其他分区
+		for i := len(g.partitions) - 1; i >= 0; i-- {
+			if err := g.partitions[i].Remove(); err != nil {
+				return err
+			}
+		}
+		delete(d.groups, name)
+	}
+	if brokerOptions.DataDir == "" {
+		return nil
+	}
+	return os.RemoveAll(queueDir(d.name))
+}
+
+// touch 记录消费者的活跃时间，新的消费者加入时唤醒等待中的消费者重新分配分区
+func (g *Group) touch(consumerId string) {
+	if consumerId == "" {
+		return
+	}
+	g.mutex.Lock()
+	_, ok := g.consumers[consumerId]
+	g.consumers[consumerId] = time.Now()
+	g.mutex.Unlock()
+	if !ok {
+		g.available.notify()
+	}
+}
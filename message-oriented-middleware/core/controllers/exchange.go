@@ -0,0 +1,584 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// exchange 的类型
+const (
+	// ExchangeDirect 路由到绑定键与路由键相同的 destination
+	ExchangeDirect = "direct"
+	// ExchangeFanout 路由到所有绑定的 destination，忽略路由键
+	ExchangeFanout = "fanout"
+	// ExchangeTopic 绑定键是以 . 分隔的模式，* 匹配一个单词，# 匹配零个或多个单词
+	ExchangeTopic = "topic"
+	// ExchangeHeaders 按消息的 Headers 路由，忽略路由键
+	ExchangeHeaders = "headers"
+
+	// MatchAll headers 类型的绑定中所有键值都与消息的 Headers 相同时匹配
+	MatchAll = "all"
+	// MatchAny headers 类型的绑定中任一键值与消息的 Headers 相同时匹配
+	MatchAny = "any"
+
+	exchangesFileName = "exchanges.json"
+)
+
+var (
+	ExchangeMap = NewExchanges()
+)
+
+// Exchange 按类型与绑定将发布的消息路由到任意数量的 destination
+type Exchange struct {
+	Type     string    `json:"type"`
+	Bindings []Binding `json:"bindings,omitempty"`
+}
+
+// Binding exchange 与 destination 的绑定
+type Binding struct {
+	DestName string `json:"destName"`
+	// RoutingKey direct 与 topic 类型的绑定键
+	RoutingKey string `json:"routingKey,omitempty"`
+	// Headers headers 类型要匹配的消息 Headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Match headers 类型的匹配方式，MatchAll 或 MatchAny
+	Match string `json:"match,omitempty"`
+}
+
+func (b Binding) equal(other Binding) bool {
+	if b.DestName != other.DestName || b.RoutingKey != other.RoutingKey || b.Match != other.Match ||
+		len(b.Headers) != len(other.Headers) {
+		return false
+	}
+	for k, v := range b.Headers {
+		if ov, ok := other.Headers[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matches 判断使用 routingKey 与 headers 发布的消息是否匹配绑定
+func (b Binding) matches(exchangeType, routingKey string, headers map[string]string) bool {
+	switch exchangeType {
+	case ExchangeFanout:
+		return true
+	case ExchangeDirect:
+		return b.RoutingKey == routingKey
+	case ExchangeTopic:
+		return matchTopic(strings.Split(b.RoutingKey, "."), strings.Split(routingKey, "."))
+	case ExchangeHeaders:
+		matched := 0
+		for k, v := range b.Headers {
+			if hv, ok := headers[k]; ok && hv == v {
+				matched++
+			}
+		}
+		if b.Match == MatchAny {
+			return matched > 0
+		}
+		return matched == len(b.Headers)
+	}
+	return false
+}
+
+// matchTopic 按单词匹配 topic 类型的绑定键，* 匹配一个单词，# 匹配零个或多个单词
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+	}
+}
+
+// validate 校验绑定，未指定的匹配方式使用 MatchAll
+func (b *Binding) validate(exchangeType string) error {
+	if b.DestName == "" {
+		return fmt.Errorf("destName can not be empty")
+	}
+	switch exchangeType {
+	case ExchangeFanout:
+		if b.RoutingKey != "" || len(b.Headers) > 0 {
+			return fmt.Errorf("%s exchange does not accept routingKey or headers in binding", exchangeType)
+		}
+	case ExchangeDirect, ExchangeTopic:
+		if len(b.Headers) > 0 {
+			return fmt.Errorf("%s exchange does not accept headers in binding", exchangeType)
+		}
+	case ExchangeHeaders:
+		if b.RoutingKey != "" || len(b.Headers) == 0 {
+			return fmt.Errorf("%s exchange requires headers and does not accept routingKey in binding", exchangeType)
+		}
+		if b.Match == "" {
+			b.Match = MatchAll
+		}
+		if b.Match != MatchAll && b.Match != MatchAny {
+			return fmt.Errorf("unknown match %s, must be %s or %s", b.Match, MatchAll, MatchAny)
+		}
+		return nil
+	}
+	if b.Match != "" {
+		return fmt.Errorf("match can only be set in binding of %s exchange", ExchangeHeaders)
+	}
+	return nil
+}
+
+// Exchanges 保存所有的 exchange 及其绑定
+type Exchanges struct {
+	mutex     sync.RWMutex
+	exchanges map[string]*Exchange
+}
+
+func NewExchanges() *Exchanges {
+	return &Exchanges{
+		exchanges: make(map[string]*Exchange),
+	}
+}
+
+// Declare 创建 exchange，已存在且类型相同时直接返回，返回值 created 表示是否新建了 exchange
+func (e *Exchanges) Declare(name, exchangeType string) (bool, error) {
+	switch exchangeType {
+	case ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders:
+	default:
+		return false, fmt.Errorf("unknown exchange type %s, must be one of %s, %s, %s, %s",
+			exchangeType, ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if ex, ok := e.exchanges[name]; ok {
+		if ex.Type != exchangeType {
+			return false, &ExchangeConflictError{Exchange: name, Type: ex.Type}
+		}
+		return false, nil
+	}
+	e.exchanges[name] = &Exchange{Type: exchangeType}
+	err := e.save()
+	if err != nil {
+		delete(e.exchanges, name)
+		return false, err
+	}
+	return true, nil
+}
+
+// ExchangeConflictError 重复创建 exchange 时指定的类型与已有的不一致
+type ExchangeConflictError struct {
+	Exchange string
+	Type     string
+}
+
+func (err *ExchangeConflictError) Error() string {
+	return fmt.Sprintf("exchange %s already exists with type %s", err.Exchange, err.Type)
+}
+
+// Delete 删除 exchange 及其所有绑定，绑定的 destination 不会被删除
+func (e *Exchanges) Delete(name string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ex, ok := e.exchanges[name]
+	if !ok {
+		return fmt.Errorf("unknown exchange %s", name)
+	}
+	delete(e.exchanges, name)
+	err := e.save()
+	if err != nil {
+		e.exchanges[name] = ex
+		return err
+	}
+	return nil
+}
+
+// Bind 将 destination 绑定到 exchange，相同的绑定已存在时直接返回
+func (e *Exchanges) Bind(name string, b Binding) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ex, ok := e.exchanges[name]
+	if !ok {
+		return fmt.Errorf("unknown exchange %s", name)
+	}
+	err := b.validate(ex.Type)
+	if err != nil {
+		return err
+	}
+	for _, existing := range ex.Bindings {
+		if existing.equal(b) {
+			return nil
+		}
+	}
+	ex.Bindings = append(ex.Bindings, b)
+	err = e.save()
+	if err != nil {
+		ex.Bindings = ex.Bindings[:len(ex.Bindings)-1]
+		return err
+	}
+	return nil
+}
+
+// Unbind 解除 exchange 与 destination 的绑定，绑定需要与 Bind 时完全相同
+func (e *Exchanges) Unbind(name string, b Binding) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ex, ok := e.exchanges[name]
+	if !ok {
+		return fmt.Errorf("unknown exchange %s", name)
+	}
+	err := b.validate(ex.Type)
+	if err != nil {
+		return err
+	}
+	for i, existing := range ex.Bindings {
+		if !existing.equal(b) {
+			continue
+		}
+		bindings := ex.Bindings
+		ex.Bindings = append(append([]Binding{}, bindings[:i]...), bindings[i+1:]...)
+		err = e.save()
+		if err != nil {
+			ex.Bindings = bindings
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("binding of dest name %s does not exist in exchange %s", b.DestName, name)
+}
+
+// unbindDest 删除所有 exchange 中与 destName 的绑定，用于删除 destination 时，持久化失败时恢复原来的绑定
+func (e *Exchanges) unbindDest(destName string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	previous := make(map[*Exchange][]Binding)
+	for _, ex := range e.exchanges {
+		bindings := make([]Binding, 0, len(ex.Bindings))
+		for _, b := range ex.Bindings {
+			if b.DestName != destName {
+				bindings = append(bindings, b)
+			}
+		}
+		if len(bindings) != len(ex.Bindings) {
+			previous[ex] = ex.Bindings
+			ex.Bindings = bindings
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	err := e.save()
+	if err != nil {
+		for ex, bindings := range previous {
+			ex.Bindings = bindings
+		}
+		return err
+	}
+	return nil
+}
+
+// List 返回所有 exchange 及其绑定
+func (e *Exchanges) List() []ExchangeInfo {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	infos := make([]ExchangeInfo, 0, len(e.exchanges))
+	for name, ex := range e.exchanges {
+		infos = append(infos, ExchangeInfo{
+			Name:     name,
+			Type:     ex.Type,
+			Bindings: append([]Binding{}, ex.Bindings...),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// route 返回使用 routingKey 与 headers 发布的消息应路由到的 destination，同一个 destination 只会出现一次
+func (e *Exchanges) route(name, routingKey string, headers map[string]string) ([]string, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	ex, ok := e.exchanges[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown exchange %s", name)
+	}
+	var dests []string
+	for _, b := range ex.Bindings {
+		if b.matches(ex.Type, routingKey, headers) && !contains(dests, b.DestName) {
+			dests = append(dests, b.DestName)
+		}
+	}
+	sort.Strings(dests)
+	return dests, nil
+}
+
+// Publish 将消息路由到所有匹配的 destination，所有 destination 中的消息使用同一个 id，
+// 没有匹配的绑定时 Unroutable 为 true
+func (e *Exchanges) Publish(ctx context.Context, name, routingKey string, payload Payload) (*ExchangePublishResp, error) {
+	dests, err := e.route(name, routingKey, payload.Headers)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ExchangePublishResp{Id: uuid.New().String(), Routed: dests, Unroutable: len(dests) == 0}
+	if resp.Unroutable {
+		logrus.WithField("exchange", name).WithField("routingKey", routingKey).Warnf("message routed to no destination")
+		return resp, nil
+	}
+	now := time.Now()
+	for _, destName := range dests {
+		dest, ok := DestinationMap.Get(destName)
+		if !ok {
+			resp.addFailed(destName, fmt.Errorf("unknown dest name %s", destName))
+			continue
+		}
+		m := message{Id: resp.Id, Payload: payload}
+		dest.defaultExpireAt(&m, now)
+		err := dest.putMessages(ctx, []message{m}, true)
+		if err != nil {
+			resp.addFailed(destName, err)
+			continue
+		}
+		resp.Delivered++
+	}
+	return resp, nil
+}
+
+func (r *ExchangePublishResp) addFailed(destName string, err error) {
+	if r.Failed == nil {
+		r.Failed = make(map[string]string)
+	}
+	r.Failed[destName] = err.Error()
+	logrus.WithField("destName", destName).Errorf("failed to route msg to dest, error = %v", err)
+}
+
+// save 持久化所有 exchange 及其绑定，调用方需持有锁
+func (e *Exchanges) save() error {
+	return saveMeta(exchangesFileName, e.exchanges)
+}
+
+func restoreExchanges() error {
+	exchanges := make(map[string]*Exchange)
+	err := loadJSON(filepath.Join(brokerOptions.DataDir, exchangesFileName), &exchanges)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	ExchangeMap.mutex.Lock()
+	defer ExchangeMap.mutex.Unlock()
+	ExchangeMap.exchanges = exchanges
+	return nil
+}
+
+// DeclareExchange 创建 exchange
+var DeclareExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept declare exchange request")
+	defer request.Body.Close()
+	v := new(DeclareExchangeReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.Exchange == "" {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "exchange can not be empty",
+		})
+		return
+	}
+
+	created, err := ExchangeMap.Declare(v.Exchange, v.Type)
+	if conflict, ok := err.(*ExchangeConflictError); ok {
+		ServeJSON(writer, http.StatusConflict, comm.ResponseData{
+			Err: conflict.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "declare exchange success",
+		Data: DeclareExchangeResp{Created: created},
+	})
+}
+
+// DeleteExchange 删除 exchange 及其所有绑定
+var DeleteExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept delete exchange request")
+	defer request.Body.Close()
+	v := new(DeleteExchangeReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	err = ExchangeMap.Delete(v.Exchange)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "delete exchange success",
+	})
+}
+
+// ListExchange 列出所有 exchange 及其绑定
+var ListExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept list exchange request")
+	defer request.Body.Close()
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "list exchange success",
+		Data: ListExchangeResp{Exchanges: ExchangeMap.List()},
+	})
+}
+
+// BindExchange 将 destination 绑定到 exchange，destination 不存在时按模板创建
+var BindExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept bind exchange request")
+	defer request.Body.Close()
+	v := new(BindingReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	_, ok, err := productDest(v.DestName)
+	if !ok {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("bind a unknown dest name %s", v.DestName),
+		})
+		return
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	err = ExchangeMap.Bind(v.Exchange, v.binding())
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "bind exchange success",
+	})
+}
+
+// UnbindExchange 解除 exchange 与 destination 的绑定
+var UnbindExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept unbind exchange request")
+	defer request.Body.Close()
+	v := new(BindingReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	err = ExchangeMap.Unbind(v.Exchange, v.binding())
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "unbind exchange success",
+	})
+}
+
+func (v *BindingReq) binding() Binding {
+	return Binding{
+		DestName:   v.DestName,
+		RoutingKey: v.RoutingKey,
+		Headers:    v.Headers,
+		Match:      v.Match,
+	}
+}
+
+// PublishExchange 发布消息到 exchange，Mandatory 为 true 且消息没有路由到任何 destination 时返回错误
+var PublishExchange http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept publish exchange request")
+	defer request.Body.Close()
+	v := new(ExchangePublishReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	payload, err := newPayload(v.Msg, v.Body, v.ContentType, v.Headers)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	payload.ReplyTo = v.ReplyTo
+	payload.CorrelationId = v.CorrelationId
+	resp, err := ExchangeMap.Publish(request.Context(), v.Exchange, v.RoutingKey, payload)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if resp.Unroutable && v.Mandatory {
+		ServeJSON(writer, http.StatusNotFound, comm.ResponseData{
+			Err:  fmt.Sprintf("msg published to exchange %s with routing key %q routed to no destination", v.Exchange, v.RoutingKey),
+			Data: resp,
+		})
+		return
+	}
+	if resp.Delivered == 0 && len(resp.Failed) > 0 {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err:  "failed to route msg to any destination",
+			Data: resp,
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "publish msg to exchange success",
+		Data: resp,
+	})
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// withUnwritableDataDir 在测试期间使用一个普通文件作为 DataDir，使所有持久化都失败
+func withUnwritableDataDir(t *testing.T) {
+	f, err := ioutil.TempFile("", "datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	saved := brokerOptions.DataDir
+	brokerOptions.DataDir = f.Name()
+	t.Cleanup(func() {
+		brokerOptions.DataDir = saved
+		os.Remove(f.Name())
+	})
+}
+
+func TestUnbindDestRestoresBindingsOnSaveFailure(t *testing.T) {
+	e := NewExchanges()
+	bindings := []Binding{{DestName: "a"}, {DestName: "b"}, {DestName: "a"}}
+	e.exchanges["fanout"] = &Exchange{Type: ExchangeFanout, Bindings: append([]Binding{}, bindings...)}
+	e.exchanges["other"] = &Exchange{Type: ExchangeFanout, Bindings: []Binding{{DestName: "c"}}}
+
+	withUnwritableDataDir(t)
+	if err := e.unbindDest("a"); err == nil {
+		t.Fatal("unbindDest with unwritable data dir succeeded, want error")
+	}
+	got := e.exchanges["fanout"].Bindings
+	if len(got) != len(bindings) {
+		t.Fatalf("bindings after failed unbind = %v, want %v", got, bindings)
+	}
+	for i := range bindings {
+		if !got[i].equal(bindings[i]) {
+			t.Fatalf("bindings after failed unbind = %v, want %v", got, bindings)
+		}
+	}
+
+	brokerOptions.DataDir = ""
+	if err := e.unbindDest("a"); err != nil {
+		t.Fatalf("unbindDest: %v", err)
+	}
+	if got := e.exchanges["fanout"].Bindings; len(got) != 1 || got[0].DestName != "b" {
+		t.Fatalf("bindings after unbind = %v, want only b", got)
+	}
+	if got := e.exchanges["other"].Bindings; len(got) != 1 || got[0].DestName != "c" {
+		t.Fatalf("bindings of other exchange = %v, want only c", got)
+	}
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestDest 创建只保存在内存中的 destination，并创建默认消费组
+func newTestDest(t *testing.T, name string, opts DestOptions) *Destination {
+	dest := NewDestination(name, opts)
+	if _, err := dest.Join(DefaultGroup, ""); err != nil {
+		t.Fatalf("join default group: %v", err)
+	}
+	return dest
+}
+
+// textMessages 构造 n 条内容依次为 prefix-0、prefix-1 ... 的文本消息
+func textMessages(prefix string, n int) []message {
+	ms := make([]message, n)
+	for i := range ms {
+		ms[i] = message{Payload: textPayload(fmt.Sprintf("%s-%d", prefix, i))}
+	}
+	return ms
+}
+
+// queueOf 返回消费组 group 的第 p 个分区
+func queueOf(t *testing.T, dest *Destination, group string, p int) *Queue {
+	g, err := dest.Group(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g.partitions[p]
+}
+
+// queueSize 返回队列中的消息总数
+func queueSize(q *Queue) int {
+	q.Lock()
+	defer q.Unlock()
+	return q.size()
+}
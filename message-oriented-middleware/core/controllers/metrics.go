@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	producedCounter     = "mq_messages_produced_total"
+	ackedCounter        = "mq_messages_acked_total"
+	expiredCounter      = "mq_messages_expired_total"
+	deadLetteredCounter = "mq_messages_dead_lettered_total"
+	droppedCounter      = "mq_messages_dropped_total"
+)
+
+var (
+	metrics = newCounters()
+)
+
+// counters 按 destination 统计的计数器
+type counters struct {
+	mutex  sync.Mutex
+	values map[string]map[string]int64
+}
+
+func newCounters() *counters {
+	return &counters{
+		values: make(map[string]map[string]int64),
+	}
+}
+
+func (c *counters) Add(name, destName string, delta int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	dests, ok := c.values[name]
+	if !ok {
+		dests = make(map[string]int64)
+		c.values[name] = dests
+	}
+	dests[destName] += delta
+}
+
+func (c *counters) Get(name, destName string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[name][destName]
+}
+
+// snapshot 返回所有计数器当前值的副本
+func (c *counters) snapshot() map[string]map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make(map[string]map[string]int64, len(c.values))
+	for name, dests := range c.values {
+		values[name] = make(map[string]int64, len(dests))
+		for destName, v := range dests {
+			values[name][destName] = v
+		}
+	}
+	return values
+}
+
+// 以 prometheus 文本格式输出所有计数器，输出时不持有锁，避免慢的抓取方阻塞生产与消费
+var Metrics http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	values := metrics.snapshot()
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(writer, "# TYPE %s counter\n", name)
+		dests := make([]string, 0, len(values[name]))
+		for destName := range values[name] {
+			dests = append(dests, destName)
+		}
+		sort.Strings(dests)
+		for _, destName := range dests {
+			fmt.Fprintf(writer, "%s{dest=%q} %d\n", name, destName, values[name][destName])
+		}
+	}
+}
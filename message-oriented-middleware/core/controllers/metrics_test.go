@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalledWriter 模拟卡住的抓取方，第一次写入时阻塞直到 release 被关闭
+type stalledWriter struct {
+	header  http.Header
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *stalledWriter) WriteHeader(int) {}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	select {
+	case <-w.writing:
+	default:
+		close(w.writing)
+		<-w.release
+	}
+	return len(b), nil
+}
+
+func TestMetricsOutput(t *testing.T) {
+	metrics.Add(producedCounter, "metrics-output", 3)
+	recorder := httptest.NewRecorder()
+	Metrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE " + producedCounter + " counter\n",
+		producedCounter + `{dest="metrics-output"} 3` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics output %q does not contain %q", body, line)
+		}
+	}
+}
+
+func TestMetricsDoesNotBlockCountersWhileWriting(t *testing.T) {
+	metrics.Add(producedCounter, "metrics-stalled", 1)
+	w := &stalledWriter{header: make(http.Header), writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Metrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	<-w.writing
+
+	added := make(chan struct{})
+	go func() {
+		metrics.Add(producedCounter, "metrics-stalled", 1)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Error("counters.Add blocked while metrics were being written")
+	}
+	close(w.release)
+	<-done
+	<-added
+}
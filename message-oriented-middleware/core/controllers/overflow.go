@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 队列已满时的处理策略
+const (
+	// OverflowReject 拒绝新的消息
+	OverflowReject = "reject"
+	// OverflowDropOldest 丢弃等待投递的最早的消息，优先级模式下先丢弃低优先级的消息
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest 丢弃新的消息，生产者不会收到错误
+	OverflowDropNewest = "drop-newest"
+	// OverflowBlock 生产者等待队列中有空间，超时后拒绝
+	OverflowBlock = "block"
+
+	defaultBlockTimeoutSeconds = 10
+)
+
+// fits 判断队列能否再容纳 n 条共 bytes 字节的消息，调用方需持有锁
+func (q *Queue) fits(n int, bytes int64) bool {
+	return q.size()+n <= q.cap && (q.maxBytes == 0 || q.bytes+bytes <= q.maxBytes)
+}
+
+// fitsAfterDrop 判断丢弃所有等待投递的消息后队列能否容纳新的消息，调用方需持有锁
+func (q *Queue) fitsAfterDrop(n int, bytes int64) bool {
+	var readyBytes int64
+	q.ready.Range(func(m *message) {
+		readyBytes += int64(len(m.Body))
+	})
+	return q.size()-q.ready.Len()+n <= q.cap && (q.maxBytes == 0 || q.bytes-readyBytes+bytes <= q.maxBytes)
+}
+
+// dropOldest 丢弃等待投递的最早的消息，直到队列能够容纳新的消息，调用方需持有锁
+func (q *Queue) dropOldest(n int, bytes int64) {
+	for !q.fits(n, bytes) {
+		m := q.ready.PopOldest()
+		if m == nil {
+			return
+		}
+		logrus.WithField("destName", q.destName).WithField("id", m.Id).Warnf("queue is full, drop the oldest message")
+		q.ack(m)
+		metrics.Add(droppedCounter, q.destName, 1)
+	}
+}
+
+// notifySpace 唤醒所有等待空间的生产者，调用方需持有锁
+func (q *Queue) notifySpace() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// putMessages 将一组消息复制到所有消费组，消费组已满时按 OverflowPolicy 处理，
+// wait 为 false 时 OverflowBlock 策略与 OverflowReject 相同
+func (d *Destination) putMessages(ctx context.Context, ms []message, wait bool) error {
+	_, err := d.storeMessages(ctx, ms, wait, false)
+	return err
+}
+
+// storeMessages 与 putMessages 相同，并返回每条消息是否至少写入了一个消费组，
+// OverflowDropNewest 策略下在所有消费组中都被丢弃的消息为 false。
+// atomic 为 true 时 OverflowDropNewest 策略下有队列已满则拒绝所有消息，不会丢弃其中的一部分
+func (d *Destination) storeMessages(ctx context.Context, ms []message, wait, atomic bool) ([]bool, error) {
+	var deadline <-chan time.Time
+	for {
+		space, stored, err := d.tryPutMessages(ms, wait, atomic)
+		if space == nil {
+			return stored, err
+		}
+		if deadline == nil {
+			timer := time.NewTimer(time.Duration(d.Options().BlockTimeoutSeconds) * time.Second)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-space:
+		case <-deadline:
+			return nil, fmt.Errorf("queue of dest name %s is still full after waiting %ds", d.name, d.Options().BlockTimeoutSeconds)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryPutMessages 所有消费组都能容纳消息时写入，OverflowBlock 策略下需要等待时返回已满队列的 space
+func (d *Destination) tryPutMessages(ms []message, wait, atomic bool) (<-chan struct{}, []bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	unlock := d.lockQueues()
+	defer unlock()
+	for i := range ms {
+		d.assignPartition(&ms[i])
+	}
+	full, space, err := d.checkPut(ms, wait)
+	if space != nil || err != nil {
+		return space, nil, err
+	}
+	if atomic && len(full) > 0 && d.opts.OverflowPolicy == OverflowDropNewest {
+		return nil, nil, fmt.Errorf("queue of dest name %s has been full", d.name)
+	}
+	stored, err := d.applyPut(ms, full)
+	return nil, stored, err
+}
+
+// lockQueues 按消费组名称与分区的顺序锁定所有消费组队列，返回解锁函数，调用方需持有 d.mutex 读锁
+func (d *Destination) lockQueues() func() {
+	names := d.groupNames()
+	for _, name := range names {
+		for _, q := range d.groups[name].partitions {
+			q.Lock()
+		}
+	}
+	return func() {
+		for _, name := range names {
+			for _, q := range d.groups[name].partitions {
+				q.Unlock()
+			}
+		}
+	}
+}
+
+func (d *Destination) groupNames() []string {
+	names := make([]string, 0, len(d.groups))
+	for name := range d.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkPut 检查所有消费组中消息所在的分区能否容纳消息，返回需要按 OverflowPolicy 处理的队列，
+// OverflowBlock 策略下需要等待时返回已满队列的 space。消息需要已经分配分区，
+// 调用方需持有 d.mutex 读锁并锁定所有消费组队列
+func (d *Destination) checkPut(ms []message, wait bool) (map[*Queue]bool, <-chan struct{}, error) {
+	if len(d.groups) == 0 {
+		return nil, nil, fmt.Errorf("dest name %s has no consumer group", d.name)
+	}
+	// 先检查所有消费组，确认消息可以写入后再丢弃旧消息，避免写入失败时白白丢弃消息
+	counts, sizes := partitionLoad(ms, d.opts.Partitions)
+	full := make(map[*Queue]bool)
+	for _, name := range d.groupNames() {
+		for p, q := range d.groups[name].partitions {
+			n, bytes := counts[p], sizes[p]
+			if n == 0 || q.fits(n, bytes) {
+				continue
+			}
+			if n > q.cap || (q.maxBytes > 0 && bytes > q.maxBytes) {
+				return nil, nil, fmt.Errorf("messages exceed the capacity of dest name %s", d.name)
+			}
+			switch d.opts.OverflowPolicy {
+			case OverflowDropOldest:
+				if !q.fitsAfterDrop(n, bytes) {
+					return nil, nil, fmt.Errorf("queue of group %s has been full of unacked messages", name)
+				}
+			case OverflowDropNewest:
+			case OverflowBlock:
+				if wait {
+					return nil, q.space, nil
+				}
+				return nil, nil, fmt.Errorf("queue of group %s has been full", name)
+			default:
+				return nil, nil, fmt.Errorf("queue of group %s has been full", name)
+			}
+			full[q] = true
+		}
+	}
+	return full, nil, nil
+}
+
+// applyPut 将消息写入所有消费组中消息所在的分区，full 中的队列按 OverflowPolicy 处理，
+// 返回每条消息是否至少写入了一个消费组，调用方需在 checkPut 之后继续持有锁
+func (d *Destination) applyPut(ms []message, full map[*Queue]bool) ([]bool, error) {
+	plan, err := d.preparePut(ms, full)
+	if err != nil {
+		return nil, err
+	}
+	plan.commit()
+	return plan.stored, nil
+}
+
+// queuePut 写入一个队列的消息
+type queuePut struct {
+	q  *Queue
+	ms []*message
+	// dropOldest 为 true 时加入队列前先丢弃最早的消息腾出空间
+	dropOldest bool
+	n          int
+	bytes      int64
+}
+
+// putPlan 已写入预写日志、尚未加入队列的一次写入，commit 后消息才对消费者可见，
+// rollback 在预写日志中确认已写入的消息，使其重启后不会恢复
+type putPlan struct {
+	destName string
+	puts     []*queuePut
+	produced int
+	// stored 每条消息是否至少写入了一个消费组
+	stored []bool
+}
+
+// preparePut 将消息写入所有消费组中消息所在分区的预写日志，OverflowDropNewest 策略下 full 中的队列直接丢弃消息。
+// 写入失败时撤回已写入的消息，调用方需在 checkPut 之后继续持有锁
+func (d *Destination) preparePut(ms []message, full map[*Queue]bool) (*putPlan, error) {
+	counts, sizes := partitionLoad(ms, d.opts.Partitions)
+	now := time.Now()
+	plan := &putPlan{destName: d.name, produced: len(ms), stored: make([]bool, len(ms))}
+	for _, name := range d.groupNames() {
+		for p, q := range d.groups[name].partitions {
+			n, bytes := counts[p], sizes[p]
+			if n == 0 {
+				continue
+			}
+			if full[q] && d.opts.OverflowPolicy == OverflowDropNewest {
+				logrus.WithField("destName", d.name).WithField("group", name).Warnf("queue is full, drop %d new messages", n)
+				metrics.Add(droppedCounter, d.name, int64(n))
+				continue
+			}
+			put := &queuePut{q: q, dropOldest: full[q], n: n, bytes: bytes}
+			plan.puts = append(plan.puts, put)
+			for i, m := range ms {
+				if m.partition != p {
+					continue
+				}
+				m := m
+				if m.CreatedAt.IsZero() {
+					m.CreatedAt = now
+				}
+				err := q.append(&m)
+				if err != nil {
+					plan.rollback()
+					return nil, err
+				}
+				put.ms = append(put.ms, &m)
+				plan.stored[i] = true
+			}
+		}
+	}
+	return plan, nil
+}
+
+// commit 将已写入预写日志的消息加入队列，调用方需在 preparePut 之后继续持有锁
+func (plan *putPlan) commit() {
+	now := time.Now()
+	for _, put := range plan.puts {
+		if put.dropOldest {
+			put.q.dropOldest(put.n, put.bytes)
+		}
+		for _, m := range put.ms {
+			put.q.enqueue(m, now)
+		}
+	}
+	metrics.Add(producedCounter, plan.destName, int64(plan.produced))
+}
+
+// rollback 在预写日志中确认已写入的消息，调用方需在 preparePut 之后继续持有锁
+func (plan *putPlan) rollback() {
+	for _, put := range plan.puts {
+		if put.q.log == nil {
+			continue
+		}
+		for _, m := range put.ms {
+			err := put.q.log.Ack(m.seq)
+			if err != nil {
+				logrus.WithField("destName", plan.destName).WithField("seq", m.seq).
+					Errorf("failed to roll back message in wal, error = %v", err)
+			}
+		}
+	}
+}
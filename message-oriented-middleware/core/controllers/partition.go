@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxPartitions = 256
+	// consumerSessionTimeout 消费者超过该时长没有消费时视为已离开消费组，其分区重新分配给其他消费者
+	consumerSessionTimeout = 30 * time.Second
+	// consumerHeartbeatInterval 消费者等待消息期间刷新活跃时间的间隔
+	consumerHeartbeatInterval = consumerSessionTimeout / 3
+)
+
+// newGroup 创建消费组及其各个分区的队列，调用方需持有 d.mutex 写锁
+func (d *Destination) newGroup(group string) (*Group, error) {
+	g := &Group{
+		name:      group,
+		consumers: make(map[string]time.Time),
+		available: newBroadcast(),
+	}
+	for p := 0; p < d.opts.Partitions; p++ {
+		q, err := newGroupQueue(d.name, group, p, d.opts, !d.temporary())
+		if err != nil {
+			for _, opened := range g.partitions {
+				opened.Close()
+			}
+			return nil, err
+		}
+		q.available = g.available
+		if d.opts.Partitions > 1 {
+			q.leasePrefix = strconv.Itoa(p) + ":"
+		}
+		q.deadLetter = func(m *message) error {
+			return d.deadLetter(group, m)
+		}
+		d.seedDedup(q)
+		g.partitions = append(g.partitions, q)
+	}
+	return g, nil
+}
+
+// assignPartition 选择消息写入的分区，相同分区键的消息写入同一个分区，
+// 没有分区键的消息轮流写入各个分区，调用方需持有 d.mutex 读锁
+func (d *Destination) assignPartition(m *message) {
+	n := d.opts.Partitions
+	switch {
+	case n <= 1:
+		m.partition = 0
+	case m.PartitionKey != "":
+		h := fnv.New32a()
+		h.Write([]byte(m.PartitionKey))
+		m.partition = int(h.Sum32() % uint32(n))
+	default:
+		m.partition = int(atomic.AddUint64(&d.nextPartition, 1) % uint64(n))
+	}
+}
+
+// partitionLoad 统计每个分区中要写入的消息数与字节数
+func partitionLoad(ms []message, partitions int) ([]int, []int64) {
+	counts := make([]int, partitions)
+	bytes := make([]int64, partitions)
+	for _, m := range ms {
+		counts[m.partition]++
+		bytes[m.partition] += int64(len(m.Body))
+	}
+	return counts, bytes
+}
+
+// owners 返回每个分区分配给的消费者，活跃的消费者按 id 排序后依次分配分区，没有活跃的消费者时返回 nil
+func (g *Group) owners(now time.Time) []string {
+	g.mutex.Lock()
+	ids := make([]string, 0, len(g.consumers))
+	for id, seen := range g.consumers {
+		if now.Sub(seen) < consumerSessionTimeout {
+			ids = append(ids, id)
+		}
+	}
+	g.mutex.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+	owners := make([]string, len(g.partitions))
+	for p := range owners {
+		owners[p] = ids[p%len(ids)]
+	}
+	return owners
+}
+
+// partitioned 判断 consumerId 是否按分区分配消费。只有一个分区或未指定 consumerId 时，
+// 消费者竞争消费所有分区，不保证分区内消息的处理顺序
+func (g *Group) partitioned(consumerId string) bool {
+	return len(g.partitions) > 1 && consumerId != ""
+}
+
+// assigned 返回分配给 consumerId 的分区
+func (g *Group) assigned(consumerId string, now time.Time) []*Queue {
+	if !g.partitioned(consumerId) {
+		return g.partitions
+	}
+	var queues []*Queue
+	for p, owner := range g.owners(now) {
+		if owner == consumerId {
+			queues = append(queues, g.partitions[p])
+		}
+	}
+	return queues
+}
+
+// partitionOf 根据租约找到消息所在的分区
+func (g *Group) partitionOf(lease string) (*Queue, error) {
+	if len(g.partitions) == 1 {
+		return g.partitions[0], nil
+	}
+	i := strings.IndexByte(lease, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid lease %s", lease)
+	}
+	p, err := strconv.Atoi(lease[:i])
+	if err != nil || p < 0 || p >= len(g.partitions) {
+		return nil, fmt.Errorf("invalid lease %s", lease)
+	}
+	return g.partitions[p], nil
+}
+
+// Get 从分配给 consumerId 的分区中获取一条消息，见 Queue.Get
+func (g *Group) Get(ctx context.Context, consumerId string, prefetch int, visibility time.Duration) *Delivery {
+	ds := g.GetBatch(ctx, consumerId, prefetch, visibility, 1)
+	if len(ds) == 0 {
+		return nil
+	}
+	return ds[0]
+}
+
+// GetBatch 从分配给 consumerId 的分区中最多获取 max 条消息，prefetch 按消费者在所有分区中未确认的消息数计算。
+// 分区重新分配后，其他消费者在该分区中还有未确认的消息时，新的消费者等待其确认或租约到期，保证分区内的消息按顺序处理。
+// 没有可投递的消息时阻塞等待，等待期间消费者的分区可能重新分配，ctx 结束时返回 nil
+func (g *Group) GetBatch(ctx context.Context, consumerId string, prefetch int, visibility time.Duration, max int) []*Delivery {
+	for {
+		available := g.available.channel()
+		now := time.Now()
+		g.touch(consumerId)
+		ds, wakeAt := g.take(g.assigned(consumerId, now), now, consumerId, prefetch, visibility, max)
+		if len(ds) > 0 {
+			return ds
+		}
+		if consumerId != "" {
+			heartbeat := now.Add(consumerHeartbeatInterval)
+			if wakeAt.IsZero() || heartbeat.Before(wakeAt) {
+				wakeAt = heartbeat
+			}
+		}
+		if !wait(ctx, available, wakeAt) {
+			return nil
+		}
+	}
+}
+
+// take 锁定 queues 并从中最多取出 max 条消息，没有消息时返回最近需要唤醒的时间
+func (g *Group) take(queues []*Queue, now time.Time, consumerId string, prefetch int, visibility time.Duration, max int) ([]*Delivery, time.Time) {
+	// 按分区顺序加锁，与生产时的加锁顺序一致
+	for _, q := range queues {
+		q.Lock()
+		q.releaseExpired(now)
+		q.promoteDue(now)
+	}
+	defer unlockAll(queues)
+
+	limit := max
+	if prefetch > 0 && consumerId != "" {
+		inflight := 0
+		for _, q := range queues {
+			inflight += q.consumerInflight[consumerId]
+		}
+		if prefetch-inflight < limit {
+			limit = prefetch - inflight
+		}
+	}
+	var ds []*Delivery
+	start := int(atomic.AddUint32(&g.next, 1))
+	for i := 0; i < len(queues) && len(ds) < limit; i++ {
+		q := queues[(start+i)%len(queues)]
+		if g.partitioned(consumerId) && q.leasedByOther(consumerId) {
+			continue
+		}
+		for len(ds) < limit {
+			d := q.take(now, consumerId, 0, visibility)
+			if d == nil {
+				break
+			}
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) > 0 {
+		return ds, time.Time{}
+	}
+	wakeAt := time.Time{}
+	for _, q := range queues {
+		t := q.nextWakeAt()
+		if !t.IsZero() && (wakeAt.IsZero() || t.Before(wakeAt)) {
+			wakeAt = t
+		}
+	}
+	return nil, wakeAt
+}
+
+// leasedByOther 判断其他消费者是否持有分区中未确认的消息，调用方需持有锁
+func (q *Queue) leasedByOther(consumerId string) bool {
+	n := len(q.consumerInflight)
+	return n > 1 || (n == 1 && q.consumerInflight[consumerId] == 0)
+}
+
+// unlockAll 释放所有队列的锁后，再将等待转入死信的消息交给 deadLetter
+func unlockAll(queues []*Queue) {
+	deadLetters := make([][]*message, len(queues))
+	for i, q := range queues {
+		deadLetters[i] = q.deadLetters
+		q.deadLetters = nil
+		q.Unlock()
+	}
+	for i, q := range queues {
+		for _, m := range deadLetters[i] {
+			q.dispatchDeadLetter(m)
+		}
+	}
+}
+
+// Ack 确认消息已被消费，见 Queue.Ack
+func (g *Group) Ack(id, lease string) error {
+	q, err := g.partitionOf(lease)
+	if err != nil {
+		return err
+	}
+	return q.Ack(id, lease)
+}
+
+// Nack 释放消息，见 Queue.Nack
+func (g *Group) Nack(id, lease, reason string) error {
+	q, err := g.partitionOf(lease)
+	if err != nil {
+		return err
+	}
+	return q.Nack(id, lease, reason)
+}
+
+// Leave 将消费者移出消费组，其分区立即分配给其他消费者，已投递的消息仍需确认或等待租约到期
+func (g *Group) Leave(consumerId string) bool {
+	g.mutex.Lock()
+	_, ok := g.consumers[consumerId]
+	delete(g.consumers, consumerId)
+	g.mutex.Unlock()
+	if ok {
+		g.available.notify()
+	}
+	return ok
+}
+
+// tick 由后台巡检协程定期调用，巡检所有分区的队列，并移除超过 consumerSessionTimeout 没有消费的消费者
+func (g *Group) tick(now time.Time) {
+	for _, q := range g.partitions {
+		q.tick(now)
+	}
+	g.mutex.Lock()
+	var expired []string
+	for id, seen := range g.consumers {
+		if now.Sub(seen) >= consumerSessionTimeout {
+			delete(g.consumers, id)
+			expired = append(expired, id)
+		}
+	}
+	g.mutex.Unlock()
+	for _, id := range expired {
+		logrus.WithField("group", g.name).WithField("consumerId", id).Infof("consumer session expired, leave group")
+	}
+	if len(expired) > 0 {
+		g.available.notify()
+	}
+}
+
+// Leave 消费者主动离开消费组，分区模式下其分区立即分配给其他消费者
+var Leave http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept leave request")
+	defer request.Body.Close()
+	v := new(LeaveReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.ConsumerId == "" {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "consumerId can not be empty",
+		})
+		return
+	}
+
+	group, err := lookupGroup(v.DestName, v.Group)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("leave a unknown dest name or group, %v", err),
+		})
+		return
+	}
+	if !group.Leave(v.ConsumerId) {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("consumer %s is not in group %s", v.ConsumerId, group.name),
+		})
+		return
+	}
+	// 临时 destination 的所有者离开后立即删除，不必等待后台巡检
+	if dest, ok := DestinationMap.Get(v.DestName); ok && dest.orphaned() {
+		removeReplyDest(dest)
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "leave group success",
+	})
+}
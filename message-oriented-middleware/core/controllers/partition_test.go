@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newPartitionedDest 创建两个分区的 destination，消费者 c1、c2 加入默认消费组
+func newPartitionedDest(t *testing.T, name string) (*Destination, *Group) {
+	dest := NewDestination(name, DestOptions{Partitions: 2})
+	var g *Group
+	for _, id := range []string{"c2", "c1"} {
+		var err error
+		if g, err = dest.Join(DefaultGroup, id); err != nil {
+			t.Fatalf("join %s: %v", id, err)
+		}
+	}
+	return dest, g
+}
+
+// putToPartition 生产一条写入第 p 个分区的消息
+func putToPartition(t *testing.T, dest *Destination, p int, body string) {
+	for i := 0; ; i++ {
+		m := message{Payload: textPayload(body), PartitionKey: fmt.Sprintf("key-%d", i)}
+		dest.assignPartition(&m)
+		if m.partition != p {
+			continue
+		}
+		if _, err := dest.Put(nil, m); err != nil {
+			t.Fatalf("put %s: %v", body, err)
+		}
+		return
+	}
+}
+
+func groupGetWithin(g *Group, consumerId string, timeout time.Duration) *Delivery {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return g.Get(ctx, consumerId, 0, time.Minute)
+}
+
+func TestPartitionAssignment(t *testing.T) {
+	dest, g := newPartitionedDest(t, "part-assign")
+	// 消费者按 id 排序后依次分配分区
+	owners := g.owners(time.Now())
+	if len(owners) != 2 || owners[0] != "c1" || owners[1] != "c2" {
+		t.Fatalf("owners = %v, want [c1 c2]", owners)
+	}
+
+	putToPartition(t, dest, 1, "p1")
+	if d := groupGetWithin(g, "c1", 50*time.Millisecond); d != nil {
+		t.Fatalf("c1 got %s from partition owned by c2", d.Body)
+	}
+	d := groupGetWithin(g, "c2", time.Second)
+	if d == nil || string(d.Body) != "p1" {
+		t.Fatalf("c2 got %v, want p1", d)
+	}
+	if q, err := g.partitionOf(d.Lease); err != nil || q != g.partitions[1] {
+		t.Fatalf("partition of lease %s = %v, %v, want partition 1", d.Lease, q, err)
+	}
+}
+
+func TestLeaveRebalancesPartitions(t *testing.T) {
+	dest, g := newPartitionedDest(t, "part-leave")
+	putToPartition(t, dest, 1, "first")
+	putToPartition(t, dest, 1, "second")
+	first := groupGetWithin(g, "c2", time.Second)
+	if first == nil || string(first.Body) != "first" {
+		t.Fatalf("c2 got %v, want first", first)
+	}
+
+	if !g.Leave("c2") {
+		t.Fatal("leave c2 returned false, want true")
+	}
+	owners := g.owners(time.Now())
+	if len(owners) != 2 || owners[0] != "c1" || owners[1] != "c1" {
+		t.Fatalf("owners after leave = %v, want [c1 c1]", owners)
+	}
+	// c2 还持有分区中未确认的消息，c1 需要等待，保证分区内的消息按顺序处理
+	if d := groupGetWithin(g, "c1", 50*time.Millisecond); d != nil {
+		t.Fatalf("c1 got %s while c2 still holds a lease in the partition", d.Body)
+	}
+
+	got := make(chan *Delivery, 1)
+	go func() {
+		got <- groupGetWithin(g, "c1", 5*time.Second)
+	}()
+	if err := g.Ack(first.Id, first.Lease); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if d := <-got; d == nil || string(d.Body) != "second" {
+		t.Fatalf("c1 got %v after ack, want second", d)
+	}
+}
+
+func TestLeaveUnknownConsumer(t *testing.T) {
+	_, g := newPartitionedDest(t, "part-unknown")
+	if g.Leave("c3") {
+		t.Fatal("leave unknown consumer returned true, want false")
+	}
+}
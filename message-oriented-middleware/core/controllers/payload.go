@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultTextContentType   = "text/plain; charset=utf-8"
+	defaultBinaryContentType = "application/octet-stream"
+)
+
+// Payload 消息内容，Body 为原始字节，Headers 为任意的键值对元数据，
+// ReplyTo 与 CorrelationId 用于请求响应模式，broker 只负责传递
+type Payload struct {
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// ReplyTo 请求的响应写入的 destination
+	ReplyTo string `json:"replyTo,omitempty"`
+	// CorrelationId 关联请求与响应，响应使用请求的 CorrelationId
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+func textPayload(msg string) Payload {
+	return Payload{Body: []byte(msg), ContentType: defaultTextContentType}
+}
+
+// newPayload 使用请求中的消息内容构造 Payload，msg 是文本消息的便捷写法，不能与 body 同时指定
+func newPayload(msg string, body []byte, contentType string, headers map[string]string) (Payload, error) {
+	if msg != "" && body != nil {
+		return Payload{}, fmt.Errorf("msg and body can not be set at the same time")
+	}
+	p := Payload{Body: body, ContentType: contentType, Headers: headers}
+	if msg != "" {
+		p.Body = []byte(msg)
+		if p.ContentType == "" {
+			p.ContentType = defaultTextContentType
+		}
+	}
+	if p.ContentType == "" {
+		p.ContentType = defaultBinaryContentType
+	}
+	return p, nil
+}
+
+// content 返回响应中的消息内容，合法 UTF-8 编码的文本消息通过 msg 字段返回，
+// 其余消息通过 body 字段返回，避免 json 编码替换非法字节后消息内容改变
+func (p Payload) content() (string, []byte) {
+	if strings.HasPrefix(p.ContentType, "text/") && utf8.Valid(p.Body) {
+		return string(p.Body), nil
+	}
+	return "", p.Body
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"container/list"
+	"time"
+)
+
+// readyQueue 等待投递的消息，每个优先级一个 FIFO 列表，未开启优先级模式时只有一个列表
+type readyQueue struct {
+	levels []list.List
+	// starvation 大于 0 时开启防饥饿，低优先级消息等待超过该时长后优先投递
+	starvation time.Duration
+	// nextOrder 消息入队的顺序号
+	nextOrder uint64
+}
+
+func newReadyQueue(maxPriority int, starvation time.Duration) readyQueue {
+	return readyQueue{
+		levels:     make([]list.List, maxPriority+1),
+		starvation: starvation,
+	}
+}
+
+func (r *readyQueue) level(m *message) *list.List {
+	p := m.Priority
+	if p < 0 {
+		p = 0
+	}
+	if p >= len(r.levels) {
+		p = len(r.levels) - 1
+	}
+	return &r.levels[p]
+}
+
+func (r *readyQueue) Len() int {
+	n := 0
+	for i := range r.levels {
+		n += r.levels[i].Len()
+	}
+	return n
+}
+
+// PushBack 将消息加入其优先级列表的队尾，并记录入队时间与顺序
+func (r *readyQueue) PushBack(m *message) {
+	m.enqueuedAt = time.Now()
+	r.nextOrder++
+	m.order = r.nextOrder
+	r.level(m).PushBack(m)
+}
+
+// PushFront 将消息放回其优先级列表的队首，保留原来的入队时间与顺序
+func (r *readyQueue) PushFront(m *message) {
+	r.level(m).PushFront(m)
+}
+
+// Front 返回下一条应投递的消息：优先级最高的列表的队首，
+// 开启防饥饿时等待超时的低优先级消息中入队最早的一条优先
+func (r *readyQueue) Front(now time.Time) *list.Element {
+	var front *list.Element
+	for i := len(r.levels) - 1; i >= 0; i-- {
+		e := r.levels[i].Front()
+		if e == nil {
+			continue
+		}
+		if front == nil {
+			front = e
+			if r.starvation <= 0 {
+				return front
+			}
+			continue
+		}
+		m := e.Value.(*message)
+		if now.Sub(m.enqueuedAt) >= r.starvation && m.enqueuedAt.Before(front.Value.(*message).enqueuedAt) {
+			front = e
+		}
+	}
+	return front
+}
+
+// Remove 删除消息并返回
+func (r *readyQueue) Remove(e *list.Element) *message {
+	m := e.Value.(*message)
+	r.level(m).Remove(e)
+	return m
+}
+
+// Range 按优先级从高到低遍历所有消息
+func (r *readyQueue) Range(fn func(m *message)) {
+	for i := len(r.levels) - 1; i >= 0; i-- {
+		for e := r.levels[i].Front(); e != nil; e = e.Next() {
+			fn(e.Value.(*message))
+		}
+	}
+}
+
+// PopOldest 删除并返回最低优先级中最早入队的消息
+func (r *readyQueue) PopOldest() *message {
+	for i := range r.levels {
+		if e := r.levels[i].Front(); e != nil {
+			return r.Remove(e)
+		}
+	}
+	return nil
+}
+
+// RemoveIf 删除所有满足条件的消息
+func (r *readyQueue) RemoveIf(fn func(m *message) bool) {
+	for i := range r.levels {
+		for e := r.levels[i].Front(); e != nil; {
+			next := e.Next()
+			if m := e.Value.(*message); fn(m) {
+				r.levels[i].Remove(e)
+			}
+			e = next
+		}
+	}
+}
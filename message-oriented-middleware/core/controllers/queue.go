@@ -2,9 +2,16 @@ package controllers
 
 import (
 	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"technology/message-oriented-middleware/core/wal"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -12,68 +19,551 @@ const (
 )
 
 type MsgQueue interface {
-	Get() string
-	Put(msg string) error
-	Done()
-	Forget()
+	Get(ctx context.Context, consumerId string, prefetch int, visibility time.Duration) *Delivery
+	Put(msg string) (string, error)
+	Ack(id, lease string) error
+	Nack(id, lease, reason string) error
 }
 
+// Queue 消息队列，ready 中按优先级保存等待投递的消息，已投递未确认的消息按租约保存在 inflight 中，
+// 同一个队列可以同时有多条消息被不同的消费者处理，投递时间未到的延迟消息保存在 scheduled 中
 type Queue struct {
 	sync.Mutex
-	list.List
-	cursor *list.Element
-	cap    int
+	ready            readyQueue
+	scheduled        scheduleHeap
+	inflight         map[string]*inflightMsg
+	consumerInflight map[string]int
+	nextExpireAt     time.Time
+	cap              int
+	// maxBytes 队列中消息内容的总字节数上限，为 0 时不限制
+	maxBytes int64
+	bytes    int64
+	// space 在有消息离开队列或容量变大时关闭并替换，用于唤醒等待空间的生产者
+	space       chan struct{}
+	log         *wal.Log
+	destName    string
+	nextSweepAt time.Time
+	// available 在有消息可以投递或消费者的未确认消息减少时通知，用于唤醒等待中的 Get，
+	// 同一消费组的各个分区共用一个
+	available *broadcast
+	// leasePrefix 分区队列的租约前缀，用于确认时找到消息所在的分区
+	leasePrefix string
+	// maxDeliveries 消息投递失败的最大次数，达到后消息交给 deadLetter 处理，为 0 时不限制
+	maxDeliveries int
+	// deadLetterExpired 为 true 时过期的消息也交给 deadLetter 处理，否则直接丢弃
+	deadLetterExpired bool
+	deadLetter        func(m *message) error
+	deadLetters       []*message
+	// removing popFront 取出、尚未 ackRemoved 或 pushFront 的消息数，这些消息仍占用队列容量
+	removing int
+}
+
+// message 队列中的消息，持久化时以 json 格式写入预写日志
+type message struct {
+	seq       uint64
+	lastError string
+	Id        string `json:"id,omitempty"`
+	Payload
+	// LegacyMsg 旧版本以文本保存的消息内容，恢复时转换为 Payload
+	LegacyMsg  string          `json:"msg,omitempty"`
+	Failures   int             `json:"failures,omitempty"`
+	DeadLetter *DeadLetterInfo `json:"deadLetter,omitempty"`
+	// DeliverAt 延迟消息的投递时间，在此之前消息对消费者不可见
+	DeliverAt *time.Time `json:"deliverAt,omitempty"`
+	// ExpireAt 消息的过期时间，过期后消息不会再被投递
+	ExpireAt *time.Time `json:"expireAt,omitempty"`
+	// Priority 消息的优先级，只在优先级模式的 destination 中生效，数值越大越先投递
+	Priority int `json:"priority,omitempty"`
+	// CreatedAt 消息写入 destination 的时间
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	// DedupKey 生产者指定的幂等键，重启后用于重建去重记录
+	DedupKey string `json:"dedupKey,omitempty"`
+	// PartitionKey 生产者指定的分区键，转入死信或送回时用于重新选择分区
+	PartitionKey string `json:"partitionKey,omitempty"`
+	enqueuedAt   time.Time
+	// order 消息入队的顺序，多条消息同时回到队首时按此排序
+	order uint64
+	// partition 消息写入的分区，不持久化，重启后由预写日志所在的目录决定
+	partition int
+}
+
+func (m *message) expired(now time.Time) bool {
+	return m.ExpireAt != nil && !now.Before(*m.ExpireAt)
+}
+
+// inflightMsg 已投递但尚未确认的消息
+type inflightMsg struct {
+	m          *message
+	consumerId string
+	expireAt   time.Time
+}
+
+// Delivery 一次消息投递，消费者需要在租约到期前使用 Lease 确认或释放消息
+type Delivery struct {
+	Id string
+	Payload
+	Lease         string
+	LeaseExpireAt time.Time
+	Failures      int
+	DeadLetter    *DeadLetterInfo
 }
 
 func NewQueue(cap int) *Queue {
+	return NewPriorityQueue(cap, 0, 0)
+}
+
+// NewPriorityQueue 创建优先级为 0 到 maxPriority 的队列，starvation 大于 0 时开启防饥饿
+func NewPriorityQueue(cap, maxPriority int, starvation time.Duration) *Queue {
 	return &Queue{
-		cap: cap,
+		ready:            newReadyQueue(maxPriority, starvation),
+		inflight:         make(map[string]*inflightMsg),
+		consumerInflight: make(map[string]int),
+		cap:              cap,
+		available:        newBroadcast(),
+		space:            make(chan struct{}),
+	}
+}
+
+// OpenQueue 打开 dir 下的预写日志，使用其中尚未被消费的消息重建队列
+func OpenQueue(dir string, cap int, opts wal.Options) (*Queue, error) {
+	q := NewQueue(cap)
+	err := q.restore(dir, opts)
+	if err != nil {
+		return nil, err
 	}
+	return q, nil
 }
 
-func (q *Queue) Put(msg string) error {
+// restore 打开 dir 下的预写日志，将其中尚未被消费的消息加入队列
+func (q *Queue) restore(dir string, opts wal.Options) error {
+	log, records, err := wal.Open(dir, opts)
+	if err != nil {
+		return err
+	}
 	q.Lock()
-	if q.List.Len() >= q.cap {
-		q.Unlock()
-		return fmt.Errorf("queue has been full")
+	defer q.Unlock()
+	q.log = log
+	now := time.Now()
+	for _, r := range records {
+		m := new(message)
+		err := json.Unmarshal(r.Data, m)
+		if err != nil {
+			logrus.WithField("dir", dir).WithField("seq", r.Seq).
+				Errorf("failed to unmarshal wal record, error = %v", err)
+			continue
+		}
+		m.seq = r.Seq
+		if m.LegacyMsg != "" && m.Body == nil {
+			m.Payload = textPayload(m.LegacyMsg)
+			m.LegacyMsg = ""
+		}
+		q.enqueue(m, now)
 	}
-	q.List.PushBack(msg)
-	q.Unlock()
 	return nil
 }
 
-func (q *Queue) Forget() {
+// size 队列中的消息总数，包含已投递未确认的消息、延迟消息与 popFront 取出尚未处理完成的消息
+func (q *Queue) size() int {
+	return q.ready.Len() + len(q.inflight) + q.scheduled.Len() + q.removing
+}
+
+// Put 写入消息，返回服务端为消息分配的 id
+func (q *Queue) Put(msg string) (string, error) {
 	q.Lock()
-	if q.cursor != nil {
-		q.List.Remove(q.cursor)
-		q.cursor = nil
+	defer q.Unlock()
+	m := &message{Id: uuid.New().String(), Payload: textPayload(msg)}
+	if !q.fits(1, int64(len(m.Body))) {
+		return "", fmt.Errorf("queue has been full")
 	}
-	q.Unlock()
+	err := q.put(m)
+	if err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
+
+// put 将消息写入预写日志并加入队列，调用方需持有锁
+func (q *Queue) put(m *message) error {
+	err := q.append(m)
+	if err != nil {
+		return err
+	}
+	q.enqueue(m, time.Now())
+	return nil
+}
+
+// append 将消息写入预写日志，调用方需持有锁
+func (q *Queue) append(m *message) error {
+	if q.log == nil {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	m.seq, err = q.log.Append(data)
+	return err
+}
+
+// Ack 确认消息已被消费，消息从队列中删除
+func (q *Queue) Ack(id, lease string) error {
+	q.Lock()
+	defer q.unlock()
+	f, err := q.takeInflight(id, lease)
+	if err != nil {
+		return err
+	}
+	q.ack(f.m)
+	metrics.Add(ackedCounter, q.destName, 1)
+	return nil
 }
 
-func (q *Queue) Done() {
+// Nack 释放消息，消息回到队首等待重新投递，reason 记录为消息最近一次失败的原因
+func (q *Queue) Nack(id, lease, reason string) error {
 	q.Lock()
-	q.cursor = nil
+	defer q.unlock()
+	f, err := q.takeInflight(id, lease)
+	if err != nil {
+		return err
+	}
+	q.release(f.m, reason)
+	return nil
+}
+
+// release 记录一次投递失败，失败次数达到 maxDeliveries 的消息等待转入死信，其余消息回到队首。
+// 失败次数写入预写日志，重启后不会重置。调用方需持有锁，并通过 unlock 释放锁
+func (q *Queue) release(m *message, reason string) {
+	m.Failures++
+	m.lastError = reason
+	q.persist(m)
+	if q.maxDeliveries > 0 && m.Failures >= q.maxDeliveries {
+		q.deadLetters = append(q.deadLetters, m)
+		return
+	}
+	q.ready.PushFront(m)
+	q.notify()
+}
+
+// unlock 释放锁，并在锁外将等待转入死信的消息交给 deadLetter，避免与死信 destination 的锁相互等待
+func (q *Queue) unlock() {
+	deadLetters := q.deadLetters
+	q.deadLetters = nil
 	q.Unlock()
+	for _, m := range deadLetters {
+		q.dispatchDeadLetter(m)
+	}
 }
 
-func (q *Queue) Get() string {
-	for {
-		q.Lock()
-		if q.cursor != nil {
-			q.Unlock()
-			time.Sleep(1 * time.Second)
-			continue
+// dispatchDeadLetter 转入死信成功后从队列中确认删除消息，失败时消息回到队尾
+func (q *Queue) dispatchDeadLetter(m *message) {
+	var err error
+	if q.deadLetter != nil {
+		err = q.deadLetter(m)
+	}
+	q.Lock()
+	defer q.Unlock()
+	if err != nil {
+		logrus.WithField("id", m.Id).Errorf("failed to dead letter message, requeue it, error = %v", err)
+		q.ready.PushBack(m)
+		q.notify()
+		return
+	}
+	q.ack(m)
+	metrics.Add(deadLetteredCounter, q.destName, 1)
+}
+
+// expire 处理过期的消息，调用方需持有锁，并通过 unlock 释放锁
+func (q *Queue) expire(m *message) {
+	logrus.WithField("destName", q.destName).WithField("id", m.Id).Infof("message expired")
+	metrics.Add(expiredCounter, q.destName, 1)
+	if q.deadLetterExpired {
+		m.lastError = "message expired"
+		q.deadLetters = append(q.deadLetters, m)
+		return
+	}
+	q.ack(m)
+}
+
+// sweepExpired 删除等待投递的消息中已过期的消息，调用方需持有锁
+func (q *Queue) sweepExpired(now time.Time) {
+	q.ready.RemoveIf(func(m *message) bool {
+		if !m.expired(now) {
+			return false
 		}
-		e := q.List.Front()
-		q.cursor = e
-		q.Unlock()
+		q.expire(m)
+		return true
+	})
+}
+
+// front 返回下一条应投递且未过期的消息，跳过的过期消息会被处理，调用方需持有锁
+func (q *Queue) front(now time.Time) *list.Element {
+	for {
+		e := q.ready.Front(now)
 		if e == nil {
-			time.Sleep(1 * time.Second)
+			return nil
+		}
+		m := e.Value.(*message)
+		if !m.expired(now) {
+			return e
+		}
+		q.ready.Remove(e)
+		q.expire(m)
+	}
+}
+
+// takeInflight 取出租约 lease 持有的消息，租约过期后消息可能已被投递给其他消费者
+func (q *Queue) takeInflight(id, lease string) (*inflightMsg, error) {
+	q.releaseExpired(time.Now())
+	f, ok := q.inflight[lease]
+	if !ok || f.m.Id != id {
+		return nil, fmt.Errorf("message %s is not in flight or lease %s has expired", id, lease)
+	}
+	q.removeInflight(lease, f)
+	return f, nil
+}
+
+func (q *Queue) removeInflight(lease string, f *inflightMsg) {
+	delete(q.inflight, lease)
+	q.consumerInflight[f.consumerId]--
+	if q.consumerInflight[f.consumerId] <= 0 {
+		delete(q.consumerInflight, f.consumerId)
+	}
+	q.notify()
+}
+
+// releaseExpired 释放租约已过期的消息，使其可以被重新投递
+func (q *Queue) releaseExpired(now time.Time) {
+	if len(q.inflight) == 0 || now.Before(q.nextExpireAt) {
+		return
+	}
+	q.nextExpireAt = time.Time{}
+	var expired []string
+	for lease, f := range q.inflight {
+		if now.After(f.expireAt) {
+			expired = append(expired, lease)
 			continue
 		}
-		return e.Value.(string)
+		if q.nextExpireAt.IsZero() || f.expireAt.Before(q.nextExpireAt) {
+			q.nextExpireAt = f.expireAt
+		}
+	}
+	// 按入队顺序倒序放回队首，使重新投递的顺序与原来的顺序一致
+	sort.Slice(expired, func(i, j int) bool {
+		return q.inflight[expired[i]].m.order > q.inflight[expired[j]].m.order
+	})
+	for _, lease := range expired {
+		f := q.inflight[lease]
+		logrus.WithField("id", f.m.Id).WithField("lease", lease).
+			WithField("consumerId", f.consumerId).Warnf("lease expired, redeliver message")
+		q.removeInflight(lease, f)
+		q.release(f.m, "lease expired")
+	}
+}
+
+// persist 将消息的最新状态写入预写日志，调用方需持有锁
+func (q *Queue) persist(m *message) {
+	if q.log == nil {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = q.log.Update(m.seq, data)
+	}
+	if err != nil {
+		logrus.WithField("seq", m.seq).Errorf("failed to update message in wal, error = %v", err)
+	}
+}
+
+// ack 在预写日志中确认消息已被消费
+func (q *Queue) ack(m *message) {
+	q.bytes -= int64(len(m.Body))
+	q.notifySpace()
+	if q.log == nil {
+		return
+	}
+	err := q.log.Ack(m.seq)
+	if err != nil {
+		logrus.WithField("seq", m.seq).Errorf("failed to ack message in wal, error = %v", err)
+	}
+}
+
+// notify 唤醒所有等待中的 Get，调用方需持有锁
+func (q *Queue) notify() {
+	q.available.notify()
+}
+
+// broadcast 通过关闭并替换 channel 唤醒所有等待者
+type broadcast struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+func newBroadcast() *broadcast {
+	return &broadcast{ch: make(chan struct{})}
+}
+
+// channel 返回下一次通知时关闭的 channel
+func (b *broadcast) channel() <-chan struct{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ch
+}
+
+func (b *broadcast) notify() {
+	b.mutex.Lock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+	b.mutex.Unlock()
+}
+
+// nextWakeAt 返回最近的租约到期或延迟消息投递的时间，没有时返回零值。
+// 后台巡检协程会在这些时间点唤醒等待者，这里用于未注册到 DestinationMap 的队列，调用方需持有锁
+func (q *Queue) nextWakeAt() time.Time {
+	wakeAt := time.Time{}
+	if len(q.inflight) > 0 {
+		wakeAt = q.nextExpireAt
+	}
+	if q.scheduled.Len() > 0 && (wakeAt.IsZero() || q.scheduled[0].DeliverAt.Before(wakeAt)) {
+		wakeAt = *q.scheduled[0].DeliverAt
+	}
+	return wakeAt
+}
+
+// wait 等待 available 被关闭或到达 wakeAt，ctx 结束时返回 false
+func wait(ctx context.Context, available <-chan struct{}, wakeAt time.Time) bool {
+	var timeout <-chan time.Time
+	if !wakeAt.IsZero() {
+		timer := time.NewTimer(time.Until(wakeAt))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-available:
+		return true
+	case <-timeout:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Get 获取队首消息并为其创建一个有效期为 visibility 的租约，租约期间消息对其他消费者不可见。
+// prefetch 大于 0 时，consumerId 未确认的消息数达到 prefetch 后会等待其确认。
+// 没有可投递的消息时阻塞等待，ctx 结束时返回 nil
+func (q *Queue) Get(ctx context.Context, consumerId string, prefetch int, visibility time.Duration) *Delivery {
+	ds := q.GetBatch(ctx, consumerId, prefetch, visibility, 1)
+	if len(ds) == 0 {
+		return nil
+	}
+	return ds[0]
+}
+
+// GetBatch 与 Get 相同，但在有消息可以投递后一次最多取出 max 条消息
+func (q *Queue) GetBatch(ctx context.Context, consumerId string, prefetch int, visibility time.Duration, max int) []*Delivery {
+	for {
+		q.Lock()
+		now := time.Now()
+		q.releaseExpired(now)
+		q.promoteDue(now)
+		var ds []*Delivery
+		for len(ds) < max {
+			d := q.take(now, consumerId, prefetch, visibility)
+			if d == nil {
+				break
+			}
+			ds = append(ds, d)
+		}
+		if len(ds) > 0 {
+			q.unlock()
+			return ds
+		}
+		available := q.available.channel()
+		wakeAt := q.nextWakeAt()
+		q.unlock()
+		if !wait(ctx, available, wakeAt) {
+			return nil
+		}
+	}
+}
+
+// take 取出一条可以投递的消息并创建租约，没有消息或 consumerId 已达到 prefetch 时返回 nil，调用方需持有锁
+func (q *Queue) take(now time.Time, consumerId string, prefetch int, visibility time.Duration) *Delivery {
+	if prefetch > 0 && consumerId != "" && q.consumerInflight[consumerId] >= prefetch {
+		return nil
+	}
+	e := q.front(now)
+	if e == nil {
+		return nil
+	}
+	m := q.ready.Remove(e)
+	lease := q.leasePrefix + uuid.New().String()
+	f := &inflightMsg{
+		m:          m,
+		consumerId: consumerId,
+		expireAt:   now.Add(visibility),
+	}
+	q.inflight[lease] = f
+	q.consumerInflight[consumerId]++
+	if q.nextExpireAt.IsZero() || f.expireAt.Before(q.nextExpireAt) {
+		q.nextExpireAt = f.expireAt
+	}
+	return &Delivery{
+		Id:            m.Id,
+		Payload:       m.Payload,
+		Lease:         lease,
+		LeaseExpireAt: f.expireAt,
+		Failures:      m.Failures,
+		DeadLetter:    m.DeadLetter,
+	}
+}
+
+// popFront 取出队首等待投递的消息，消息仍保留在预写日志中并继续占用队列容量，
+// 调用方处理完成后需调用 ackRemoved 或 pushFront
+func (q *Queue) popFront() *message {
+	q.Lock()
+	defer q.unlock()
+	now := time.Now()
+	q.releaseExpired(now)
+	q.promoteDue(now)
+	e := q.front(now)
+	if e == nil {
+		return nil
+	}
+	q.removing++
+	return q.ready.Remove(e)
+}
+
+// pushFront 将 popFront 取出的消息放回队首
+func (q *Queue) pushFront(m *message) {
+	q.Lock()
+	q.removing--
+	q.ready.PushFront(m)
+	q.notify()
+	q.Unlock()
+}
+
+// ackRemoved 在预写日志中确认 popFront 取出的消息，并释放其占用的容量
+func (q *Queue) ackRemoved(m *message) {
+	q.Lock()
+	q.removing--
+	q.ack(m)
+	q.Unlock()
+}
+
+// Close 关闭队列的预写日志
+func (q *Queue) Close() error {
+	if q.log == nil {
+		return nil
+	}
+	return q.log.Close()
+}
+
+// Remove 关闭队列并删除其预写日志
+func (q *Queue) Remove() error {
+	if q.log == nil {
+		return nil
 	}
+	return q.log.Remove()
 }
 
 //type Queue struct {
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// getWithin 在 timeout 内获取一条消息，没有消息时返回 nil
+func getWithin(q *Queue, consumerId string, prefetch int, visibility, timeout time.Duration) *Delivery {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return q.Get(ctx, consumerId, prefetch, visibility)
+}
+
+func mustPut(t *testing.T, q *Queue, msgs ...string) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		id, err := q.Put(msg)
+		if err != nil {
+			t.Fatalf("put %s: %v", msg, err)
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+func TestAck(t *testing.T) {
+	q := NewQueue(10)
+	ids := mustPut(t, q, "a")
+	d := getWithin(q, "c1", 0, time.Minute, time.Second)
+	if d == nil || d.Id != ids[0] || string(d.Body) != "a" {
+		t.Fatalf("got delivery %+v, want message a", d)
+	}
+	if err := q.Ack(d.Id, "unknown-lease"); err == nil {
+		t.Fatal("ack with unknown lease succeeded, want error")
+	}
+	if err := q.Ack(d.Id, d.Lease); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if n := queueSize(q); n != 0 {
+		t.Fatalf("queue size after ack = %d, want 0", n)
+	}
+	if err := q.Ack(d.Id, d.Lease); err == nil {
+		t.Fatal("second ack with the same lease succeeded, want error")
+	}
+}
+
+func TestNackRedeliversFirst(t *testing.T) {
+	q := NewQueue(10)
+	ids := mustPut(t, q, "a", "b")
+	d := getWithin(q, "c1", 0, time.Minute, time.Second)
+	if err := q.Nack(d.Id, d.Lease, "handler failed"); err != nil {
+		t.Fatalf("nack: %v", err)
+	}
+	if err := q.Ack(d.Id, d.Lease); err == nil {
+		t.Fatal("ack after nack succeeded, want error")
+	}
+
+	// 被释放的消息回到队首，记录失败次数，并使用新的租约
+	redelivered := getWithin(q, "c2", 0, time.Minute, time.Second)
+	if redelivered == nil || redelivered.Id != ids[0] || redelivered.Failures != 1 {
+		t.Fatalf("got delivery %+v, want message a with 1 failure", redelivered)
+	}
+	if redelivered.Lease == d.Lease {
+		t.Fatal("redelivered message reuses the released lease")
+	}
+	if err := q.Ack(redelivered.Id, redelivered.Lease); err != nil {
+		t.Fatalf("ack redelivered message: %v", err)
+	}
+}
+
+func TestInflightMessagesAreInvisible(t *testing.T) {
+	q := NewQueue(10)
+	ids := mustPut(t, q, "a", "b")
+	first := getWithin(q, "c1", 0, time.Minute, time.Second)
+	second := getWithin(q, "c2", 0, time.Minute, time.Second)
+	if first == nil || second == nil || first.Id != ids[0] || second.Id != ids[1] {
+		t.Fatalf("got deliveries %+v and %+v, want a and b", first, second)
+	}
+	if d := getWithin(q, "c3", 0, time.Minute, 50*time.Millisecond); d != nil {
+		t.Fatalf("got delivery %+v while all messages are in flight, want none", d)
+	}
+}
+
+func TestExpiredLeaseRedelivers(t *testing.T) {
+	q := NewQueue(10)
+	ids := mustPut(t, q, "a")
+	d := getWithin(q, "c1", 0, 20*time.Millisecond, time.Second)
+	if d == nil {
+		t.Fatal("no delivery")
+	}
+
+	// 租约到期前其他消费者等待，到期后消息重新投递
+	redelivered := getWithin(q, "c2", 0, time.Minute, time.Second)
+	if redelivered == nil || redelivered.Id != ids[0] || redelivered.Failures != 1 {
+		t.Fatalf("got delivery %+v after lease expired, want message a with 1 failure", redelivered)
+	}
+	if err := q.Ack(d.Id, d.Lease); err == nil {
+		t.Fatal("ack with expired lease succeeded, want error")
+	}
+	if err := q.Ack(redelivered.Id, redelivered.Lease); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+}
+
+func TestPrefetchLimitsUnackedMessages(t *testing.T) {
+	q := NewQueue(10)
+	ids := mustPut(t, q, "a", "b", "c")
+	first := getWithin(q, "c1", 2, time.Minute, time.Second)
+	second := getWithin(q, "c1", 2, time.Minute, time.Second)
+	if first == nil || second == nil {
+		t.Fatal("consumer got fewer than prefetch messages")
+	}
+	if d := getWithin(q, "c1", 2, time.Minute, 50*time.Millisecond); d != nil {
+		t.Fatalf("consumer with 2 unacked messages got %+v, want none with prefetch 2", d)
+	}
+
+	// prefetch 只限制同一个消费者，其他消费者仍可以消费
+	other := getWithin(q, "c2", 2, time.Minute, time.Second)
+	if other == nil || other.Id != ids[2] {
+		t.Fatalf("other consumer got %+v, want message c", other)
+	}
+
+	// 确认后等待中的消费者被唤醒
+	mustPut(t, q, "d")
+	got := make(chan *Delivery)
+	go func() {
+		got <- getWithin(q, "c1", 2, time.Minute, time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := q.Ack(first.Id, first.Lease); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if d := <-got; d == nil || string(d.Body) != "d" {
+		t.Fatalf("consumer got %+v after ack, want message d", d)
+	}
+}
+
+func TestGetBatchRespectsPrefetch(t *testing.T) {
+	q := NewQueue(10)
+	mustPut(t, q, "a", "b", "c", "d")
+	ds := q.GetBatch(context.Background(), "c1", 3, time.Minute, 10)
+	if len(ds) != 3 {
+		t.Fatalf("got %d deliveries with prefetch 3, want 3", len(ds))
+	}
+	// 未指定 consumerId 时不限制
+	ds = q.GetBatch(context.Background(), "", 1, time.Minute, 10)
+	if len(ds) != 1 || string(ds[0].Body) != "d" {
+		t.Fatalf("anonymous consumer got %d deliveries, want the remaining message d", len(ds))
+	}
+}
+
+func TestExpiredLeasesRedeliverInOrder(t *testing.T) {
+	q := NewQueue(20)
+	msgs := make([]string, 10)
+	for i := range msgs {
+		msgs[i] = string(rune('a' + i))
+	}
+	ids := mustPut(t, q, msgs...)
+	if ds := q.GetBatch(context.Background(), "c1", 0, 10*time.Millisecond, len(ids)); len(ds) != len(ids) {
+		t.Fatalf("got %d deliveries, want %d", len(ds), len(ids))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ds := q.GetBatch(context.Background(), "c2", 0, time.Minute, len(ids))
+	if len(ds) != len(ids) {
+		t.Fatalf("got %d redeliveries, want %d", len(ds), len(ids))
+	}
+	for i, d := range ds {
+		if d.Id != ids[i] {
+			t.Fatalf("redelivery %d is %s, want %s in original order", i, d.Body, msgs[i])
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"technology/message-oriented-middleware/comm"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// replyDestPrefix 临时 destination 名称的前缀
+	replyDestPrefix = "reply."
+)
+
+// NewReplyDest 创建所有者为 owner 的临时 destination，用于接收请求的响应。
+// 临时 destination 只保存在内存中，只有所有者可以消费，
+// 所有者离开默认消费组或超过 consumerSessionTimeout 没有消费时被删除，其中尚未消费的响应随之丢弃
+func (dm *DestMap) NewReplyDest(owner string, opts DestOptions) (*Destination, error) {
+	dest := NewDestination(replyDestPrefix+uuid.New().String(), opts)
+	dest.owner = owner
+	// 加入 DestMap 之前创建默认消费组并记录所有者，避免后台巡检将其视为所有者已离开
+	_, err := dest.Join(DefaultGroup, owner)
+	if err != nil {
+		return nil, err
+	}
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.keyMDest[dest.name] = dest
+	return dest, nil
+}
+
+// remove 删除 dest，dest 已被删除或替换时直接返回
+func (dm *DestMap) remove(dest *Destination) (bool, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.keyMDest[dest.name] != dest {
+		return false, nil
+	}
+	delete(dm.keyMDest, dest.name)
+	return true, dest.Remove()
+}
+
+// temporary 判断 destination 是否为临时 destination
+func (d *Destination) temporary() bool {
+	return d.owner != ""
+}
+
+// checkOwner 临时 destination 只有所有者可以加入与消费
+func (d *Destination) checkOwner(consumerId string) error {
+	if d.temporary() && consumerId != d.owner {
+		return fmt.Errorf("dest name %s is an exclusive reply dest of another consumer", d.name)
+	}
+	return nil
+}
+
+// orphaned 判断临时 destination 的所有者是否已离开默认消费组
+func (d *Destination) orphaned() bool {
+	if !d.temporary() {
+		return false
+	}
+	g, err := d.Group(DefaultGroup)
+	if err != nil {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	_, ok := g.consumers[d.owner]
+	return !ok
+}
+
+// removeReplyDest 删除所有者已离开的临时 destination 及其绑定
+func removeReplyDest(dest *Destination) {
+	removed, err := DestinationMap.remove(dest)
+	if err == nil && removed {
+		err = ExchangeMap.unbindDest(dest.name)
+	}
+	if err != nil {
+		logrus.WithField("destName", dest.name).Errorf("failed to remove reply dest, error = %v", err)
+		return
+	}
+	if removed {
+		logrus.WithField("destName", dest.name).WithField("owner", dest.owner).Infof("owner left, remove reply dest")
+	}
+}
+
+// lookupConsumerGroup 与 lookupGroup 相同，并校验 consumerId 可以消费该 destination
+func lookupConsumerGroup(destName, group, consumerId string) (*Group, error) {
+	dest, ok := DestinationMap.Get(destName)
+	if !ok {
+		return nil, fmt.Errorf("unknown dest name %s", destName)
+	}
+	if err := dest.checkOwner(consumerId); err != nil {
+		return nil, err
+	}
+	return dest.Group(group)
+}
+
+// CreateReplyDest 创建临时的响应 destination，请求方将其作为请求消息的 ReplyTo
+var CreateReplyDest http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept create reply dest request")
+	defer request.Body.Close()
+	v := new(ReplyDestReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.ConsumerId == "" {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "consumerId can not be empty",
+		})
+		return
+	}
+	opts := DestOptions{
+		Capacity:   v.Capacity,
+		TTLSeconds: v.TTLSeconds,
+	}
+	err = opts.validate()
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	dest, err := DestinationMap.NewReplyDest(v.ConsumerId, opts)
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "create reply dest success",
+		Data: ReplyDestResp{DestName: dest.name},
+	})
+}
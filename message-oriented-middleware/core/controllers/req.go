@@ -1,18 +1,519 @@
 package controllers
 
+import "time"
+
+// RegistryReq 注册 destination 并加入消费组，destination 已存在时请求中指定的配置需要与已有的配置一致，未指定的配置不参与比较
 type RegistryReq struct {
 	DestName string `json:"destName,omitempty"`
+	// Group 消费组，为空时使用默认消费组
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// MaxDeliveries 消息投递失败的最大次数，达到后消息转入 DeadLetterDest
+	MaxDeliveries  int    `json:"maxDeliveries,omitempty"`
+	DeadLetterDest string `json:"deadLetterDest,omitempty"`
+	// TTLSeconds 消息默认的存活时间，单位秒
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// DeadLetterExpired 为 true 时过期的消息转入 DeadLetterDest，未指定时不参与比较
+	DeadLetterExpired *bool `json:"deadLetterExpired,omitempty"`
+	// MaxPriority 大于 0 时开启优先级模式，消息优先级的取值范围为 0 到 MaxPriority
+	MaxPriority int `json:"maxPriority,omitempty"`
+	// StarvationSeconds 大于 0 时开启防饥饿，低优先级消息等待超过该秒数后优先投递
+	StarvationSeconds int `json:"starvationSeconds,omitempty"`
+	// Capacity 每个消费组队列最多容纳的消息数，为 0 时使用默认值
+	Capacity int `json:"capacity,omitempty"`
+	// MaxBytes 每个消费组队列中消息内容的总字节数上限，为 0 时不限制
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// OverflowPolicy 队列已满时的处理策略，reject、drop-oldest、drop-newest 或 block，默认为 reject
+	OverflowPolicy string `json:"overflowPolicy,omitempty"`
+	// BlockTimeoutSeconds block 策略下生产者最多等待的秒数，为 0 时使用默认值
+	BlockTimeoutSeconds int `json:"blockTimeoutSeconds,omitempty"`
+	// DedupWindowSeconds 带有幂等键的消息的去重窗口，单位秒，为 0 时使用默认值
+	DedupWindowSeconds int `json:"dedupWindowSeconds,omitempty"`
+	// DedupMaxEntries 去重窗口内最多记录的幂等键数，为 0 时使用默认值
+	DedupMaxEntries int `json:"dedupMaxEntries,omitempty"`
+	// Partitions 每个消费组的分区数，大于 1 时开启分区模式，相同分区键的消息按顺序投递给同一个消费者
+	Partitions int `json:"partitions,omitempty"`
+	// Force 为 true 时，已有的 destination 配置与请求不一致则删除并重新创建，其中的消息全部丢弃
+	Force bool `json:"force,omitempty"`
+}
+
+// RegistryResp 返回 destination 实际生效的配置
+type RegistryResp struct {
+	Options DestOptions `json:"options"`
+	// Created 为 true 时表示本次注册新建了 destination
+	Created bool `json:"created,omitempty"`
 }
 
 type ConsumeReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Prefetch 该消费者最多可以持有的未确认消息数，为 0 或未指定 ConsumerId 时不限制
+	Prefetch int `json:"prefetch,omitempty"`
+	// VisibilityTimeout 租约时长，单位秒，超时未确认的消息会被重新投递
+	VisibilityTimeout int `json:"visibilityTimeout,omitempty"`
+	// WaitSeconds 没有消息时最多等待的秒数，为 0 时一直等待到有消息或请求结束
+	WaitSeconds int `json:"waitSeconds,omitempty"`
+}
+
+// ReplyDestReq 创建临时的响应 destination
+type ReplyDestReq struct {
+	// ConsumerId 临时 destination 的所有者，只有所有者可以消费，所有者离开默认消费组或会话过期后 destination 被删除
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Capacity 队列的容量，为 0 时使用默认值
+	Capacity int `json:"capacity,omitempty"`
+	// TTLSeconds 响应默认的存活时间，单位秒，为 0 时不过期
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+}
+
+type ReplyDestResp struct {
 	DestName string `json:"destName,omitempty"`
 }
 
+// LeaveReq 消费者离开消费组
+type LeaveReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+}
+
 type ConsumeResp struct {
-	Msg string `json:"msg,omitempty"`
+	Id string `json:"id,omitempty"`
+	// Msg 合法 UTF-8 编码的文本消息的内容，其余消息的内容在 Body 中
+	Msg           string            `json:"msg,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ReplyTo       string            `json:"replyTo,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	Lease         string            `json:"lease,omitempty"`
+	LeaseExpireAt time.Time         `json:"leaseExpireAt,omitempty"`
+	// Failures 消息此前投递失败的次数
+	Failures int `json:"failures,omitempty"`
+	// DeadLetter 死信消息的元数据，普通消息为空
+	DeadLetter *DeadLetterInfo `json:"deadLetter,omitempty"`
+	// TimedOut 为 true 时表示等待超时，没有消费到消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type SubscribeReq struct {
+	DestName   string `json:"destName,omitempty"`
+	Group      string `json:"group,omitempty"`
+	ConsumerId string `json:"consumerId,omitempty"`
+	// Credit 最多推送的未确认消息数，为 0 时使用默认值
+	Credit int `json:"credit,omitempty"`
+	// VisibilityTimeout 租约时长，单位秒，超时未确认的消息会被重新投递
+	VisibilityTimeout int `json:"visibilityTimeout,omitempty"`
 }
 
 type ProductReq struct {
 	DestName string `json:"destName,omitempty"`
-	Msg      string `json:"msg,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// DeliverAt 消息的投递时间，在此之前消息对消费者不可见
+	DeliverAt *time.Time `json:"deliverAt,omitempty"`
+	// DelaySeconds 消息延迟投递的秒数，不能与 DeliverAt 同时指定
+	DelaySeconds int `json:"delaySeconds,omitempty"`
+	// TTLSeconds 消息的存活时间，单位秒，延迟消息从投递时间开始计算，为 0 时使用 destination 的默认值
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Priority 消息的优先级，只能用于优先级模式的 destination，数值越大越先投递
+	Priority int `json:"priority,omitempty"`
+	// IdempotencyKey 幂等键，去重窗口内使用相同幂等键生产的消息只会写入一次
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// ProducerId 与 Seq 未指定 IdempotencyKey 时作为幂等键，同一个生产者的每条消息使用不同的 Seq
+	ProducerId string `json:"producerId,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+	// PartitionKey 分区键，分区模式下相同分区键的消息写入同一个分区，未指定时轮流写入各个分区
+	PartitionKey string `json:"partitionKey,omitempty"`
+	// ReplyTo 请求的响应写入的 destination，通常是请求方创建的临时 destination
+	ReplyTo string `json:"replyTo,omitempty"`
+	// CorrelationId 关联请求与响应，响应使用请求的 CorrelationId
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+type ProductResp struct {
+	Id string `json:"id,omitempty"`
+	// Duplicate 为 true 时表示消息已经生产过，Id 为原消息的 id
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+type ProductBatchReq struct {
+	DestName string `json:"destName,omitempty"`
+	// Atomic 为 true 时全部消息都写入成功或全部不写入，否则逐条写入并分别返回结果
+	Atomic bool `json:"atomic,omitempty"`
+	// Messages 待写入的消息，其中的 DestName 可以省略
+	Messages []ProductReq `json:"messages,omitempty"`
+}
+
+type ProductBatchResp struct {
+	// Results 与请求中的消息一一对应
+	Results []ProductBatchResult `json:"results,omitempty"`
+}
+
+type ProductBatchResult struct {
+	Id        string `json:"id,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Err       string `json:"err,omitempty"`
+}
+
+// CreateStreamReq 创建 stream，stream 中的消息被消费后不会删除，按保留策略清理
+type CreateStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// RetentionSeconds 消息保留的秒数，为 0 时不按时间清理
+	RetentionSeconds int `json:"retentionSeconds,omitempty"`
+	// RetentionBytes 保留的消息内容总字节数上限，超过后从最早的消息开始清理，为 0 时不限制
+	RetentionBytes int64 `json:"retentionBytes,omitempty"`
+}
+
+type CreateStreamResp struct {
+	Options StreamOptions `json:"options"`
+	// Created 为 true 时表示本次请求新建了 stream
+	Created bool `json:"created,omitempty"`
+}
+
+// StreamReq 查看或删除 stream
+type StreamReq struct {
+	Stream string `json:"stream,omitempty"`
+}
+
+type AppendStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type AppendStreamResp struct {
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ReadStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	// Group 消费组，未指定 Offset 时从消费组提交的位置开始读取，消费组第一次读取时从末尾开始
+	Group string `json:"group,omitempty"`
+	// Offset 开始读取的位置，指定时忽略消费组的消费位置
+	Offset *int64 `json:"offset,omitempty"`
+	// Max 最多读取的消息数，为 0 时使用默认值
+	Max int `json:"max,omitempty"`
+	// WaitSeconds 没有新消息时最多等待的秒数，为 0 时一直等待到有消息或请求结束
+	WaitSeconds int `json:"waitSeconds,omitempty"`
+}
+
+type StreamRecord struct {
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	// Msg 合法 UTF-8 编码的文本消息的内容，其余消息的内容在 Body 中
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type ReadStreamResp struct {
+	Records []StreamRecord `json:"records,omitempty"`
+	// NextOffset 下一次读取的位置，处理完 Records 后提交该值
+	NextOffset int64 `json:"nextOffset"`
+	// TimedOut 为 true 时表示等待超时，没有新的消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type CommitStreamOffsetReq struct {
+	Stream string `json:"stream,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Offset 下一条要消费的消息的位置
+	Offset int64 `json:"offset"`
+}
+
+type SeekStreamReq struct {
+	Stream string `json:"stream,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Position beginning、end 或 timestamp
+	Position string `json:"position,omitempty"`
+	// Timestamp Position 为 timestamp 时移动到第一条写入时间不早于该时间的消息
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+type SeekStreamResp struct {
+	Offset int64 `json:"offset"`
+}
+
+// StreamInfo stream 保留的消息范围与各消费组的消费位置
+type StreamInfo struct {
+	Name    string        `json:"name,omitempty"`
+	Options StreamOptions `json:"options"`
+	// StartOffset 最早保留的消息的位置
+	StartOffset int64 `json:"startOffset"`
+	// EndOffset 下一条写入的消息的位置
+	EndOffset int64             `json:"endOffset"`
+	Messages  int               `json:"messages"`
+	Bytes     int64             `json:"bytes"`
+	Groups    []StreamGroupInfo `json:"groups,omitempty"`
+}
+
+type StreamGroupInfo struct {
+	Name   string `json:"name,omitempty"`
+	Offset int64  `json:"offset"`
+	// Lag 消费组尚未消费的消息数
+	Lag int64 `json:"lag"`
+}
+
+type BeginTxReq struct {
+	// TimeoutSeconds 事务的超时时间，超时未提交的事务自动放弃，为 0 时使用默认值
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+type BeginTxResp struct {
+	TxId     string    `json:"txId,omitempty"`
+	ExpireAt time.Time `json:"expireAt,omitempty"`
+}
+
+// TxPutReq 在事务中暂存一条消息，消息的字段与 ProductReq 相同，不支持幂等键
+type TxPutReq struct {
+	TxId string `json:"txId,omitempty"`
+	ProductReq
+}
+
+type TxReq struct {
+	TxId string `json:"txId,omitempty"`
+}
+
+type CommitTxResp struct {
+	// Ids 事务中所有消息的 id，按暂存的顺序排列
+	Ids []string `json:"ids,omitempty"`
+}
+
+type ConsumeBatchReq struct {
+	DestName          string `json:"destName,omitempty"`
+	Group             string `json:"group,omitempty"`
+	ConsumerId        string `json:"consumerId,omitempty"`
+	Prefetch          int    `json:"prefetch,omitempty"`
+	VisibilityTimeout int    `json:"visibilityTimeout,omitempty"`
+	WaitSeconds       int    `json:"waitSeconds,omitempty"`
+	// Max 最多返回的消息数，有消息可以投递时立即返回，不会等待凑满
+	Max int `json:"max,omitempty"`
+}
+
+type ConsumeBatchResp struct {
+	Messages []ConsumeResp `json:"messages,omitempty"`
+	// TimedOut 为 true 时表示等待超时，没有消费到消息
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+type AckReq struct {
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Id       string `json:"id,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+}
+
+type NackReq struct {
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Id       string `json:"id,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+	// Error 处理失败的原因，消息转入死信时会被记录
+	Error string `json:"error,omitempty"`
+}
+
+type SubscribeTopicReq struct {
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	// Capacity 订阅的容量，只在创建订阅时生效
+	Capacity int `json:"capacity,omitempty"`
+}
+
+type UnsubscribeTopicReq struct {
+	Topic        string `json:"topic,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+}
+
+type PublishReq struct {
+	Topic string `json:"topic,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type PublishResp struct {
+	Id string `json:"id,omitempty"`
+	// Delivered 成功写入的订阅数
+	Delivered int `json:"delivered"`
+	// Failed 写入失败的订阅及失败原因
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+type DeclareExchangeReq struct {
+	Exchange string `json:"exchange,omitempty"`
+	// Type exchange 的类型，direct、fanout、topic 或 headers
+	Type string `json:"type,omitempty"`
+}
+
+type DeclareExchangeResp struct {
+	// Created 为 true 时表示本次请求新建了 exchange
+	Created bool `json:"created,omitempty"`
+}
+
+type DeleteExchangeReq struct {
+	Exchange string `json:"exchange,omitempty"`
+}
+
+// BindingReq 绑定或解除绑定 exchange 与 destination，解除绑定时各字段需要与绑定时相同
+type BindingReq struct {
+	Exchange string `json:"exchange,omitempty"`
+	DestName string `json:"destName,omitempty"`
+	// RoutingKey direct 类型为完整的路由键，topic 类型为以 . 分隔的模式，* 匹配一个单词，# 匹配零个或多个单词
+	RoutingKey string `json:"routingKey,omitempty"`
+	// Headers headers 类型要匹配的消息 Headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Match headers 类型的匹配方式，all 或 any，默认为 all
+	Match string `json:"match,omitempty"`
+}
+
+type ListExchangeResp struct {
+	Exchanges []ExchangeInfo `json:"exchanges,omitempty"`
+}
+
+type ExchangeInfo struct {
+	Name     string    `json:"name,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Bindings []Binding `json:"bindings,omitempty"`
+}
+
+type ExchangePublishReq struct {
+	Exchange   string `json:"exchange,omitempty"`
+	RoutingKey string `json:"routingKey,omitempty"`
+	// Msg 文本消息的便捷写法，不能与 Body 同时指定
+	Msg         string            `json:"msg,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// ReplyTo 与 CorrelationId 见 ProductReq
+	ReplyTo       string `json:"replyTo,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Mandatory 为 true 时，消息没有路由到任何 destination 则返回错误
+	Mandatory bool `json:"mandatory,omitempty"`
+}
+
+type ExchangePublishResp struct {
+	Id string `json:"id,omitempty"`
+	// Routed 匹配的 destination
+	Routed []string `json:"routed,omitempty"`
+	// Delivered 成功写入的 destination 数
+	Delivered int `json:"delivered"`
+	// Failed 写入失败的 destination 及失败原因
+	Failed map[string]string `json:"failed,omitempty"`
+	// Unroutable 为 true 时表示消息没有匹配任何绑定，消息被丢弃
+	Unroutable bool `json:"unroutable,omitempty"`
+}
+
+type RedriveReq struct {
+	// DestName 死信 destination
+	DestName string `json:"destName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	// Max 最多送回的消息数，为 0 时送回所有消息
+	Max int `json:"max,omitempty"`
+}
+
+type RedriveResp struct {
+	Redriven int `json:"redriven"`
+	Failed   int `json:"failed"`
+}
+
+type ListDestResp struct {
+	Destinations []DestSummary `json:"destinations,omitempty"`
+}
+
+type DestSummary struct {
+	Name    string      `json:"name,omitempty"`
+	Options DestOptions `json:"options"`
+}
+
+type DescribeDestReq struct {
+	DestName string `json:"destName,omitempty"`
+}
+
+type DestInfo struct {
+	Name    string      `json:"name,omitempty"`
+	Options DestOptions `json:"options"`
+	// Owner 临时 destination 的所有者，普通 destination 为空
+	Owner  string      `json:"owner,omitempty"`
+	Groups []GroupInfo `json:"groups,omitempty"`
+}
+
+// GroupInfo 消费组队列的状态
+type GroupInfo struct {
+	Name string `json:"name,omitempty"`
+	// Depth 尚未确认的消息总数，包括 Ready、Inflight 与 Scheduled
+	Depth     int `json:"depth"`
+	Ready     int `json:"ready"`
+	Inflight  int `json:"inflight"`
+	Scheduled int `json:"scheduled"`
+	Capacity  int `json:"capacity"`
+	// Bytes 队列中消息内容的总字节数
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// Consumers 消费组中活跃的消费者数
+	Consumers int `json:"consumers"`
+	// OldestMessageAgeSeconds 等待投递或未确认的消息中最早写入的消息的存在时长
+	OldestMessageAgeSeconds float64 `json:"oldestMessageAgeSeconds"`
+	// Partitions 分区模式下每个分区的状态
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+}
+
+// PartitionInfo 消费组中一个分区的状态
+type PartitionInfo struct {
+	Partition int `json:"partition"`
+	// Owner 分区当前分配给的消费者，没有活跃的消费者时为空
+	Owner     string `json:"owner,omitempty"`
+	Depth     int    `json:"depth"`
+	Ready     int    `json:"ready"`
+	Inflight  int    `json:"inflight"`
+	Scheduled int    `json:"scheduled"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type DeleteDestReq struct {
+	DestName string `json:"destName,omitempty"`
+}
+
+type PurgeDestReq struct {
+	DestName string `json:"destName,omitempty"`
+	// Group 为空时清空所有消费组
+	Group string `json:"group,omitempty"`
+}
+
+type PurgeDestResp struct {
+	Purged int `json:"purged"`
+}
+
+type SetDestCapacityReq struct {
+	DestName string `json:"destName,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+	// MaxBytes 为 nil 时不修改字节数上限，为 0 时取消限制
+	MaxBytes *int64 `json:"maxBytes,omitempty"`
+}
+
+// newConsumeResp 合法 UTF-8 编码的文本消息通过 Msg 返回，其余消息通过 Body 返回
+func newConsumeResp(d *Delivery) ConsumeResp {
+	resp := ConsumeResp{
+		Id:            d.Id,
+		ContentType:   d.ContentType,
+		Headers:       d.Headers,
+		ReplyTo:       d.ReplyTo,
+		CorrelationId: d.CorrelationId,
+		Lease:         d.Lease,
+		LeaseExpireAt: d.LeaseExpireAt,
+		Failures:      d.Failures,
+		DeadLetter:    d.DeadLetter,
+	}
+	resp.Msg, resp.Body = d.content()
+	return resp
 }
@@ -0,0 +1,46 @@
+package controllers
+
+import "net/http"
+
+// NewServeMux 注册 broker 的所有 HTTP 接口
+func NewServeMux() *http.ServeMux {
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/registry", Registry)
+	serverMux.HandleFunc("/consume", Consume)
+	serverMux.HandleFunc("/consume/batch", ConsumeBatch)
+	serverMux.HandleFunc("/subscribe", Subscribe)
+	serverMux.HandleFunc("/product", Product)
+	serverMux.HandleFunc("/product/batch", ProductBatch)
+	serverMux.HandleFunc("/ack", Ack)
+	serverMux.HandleFunc("/nack", Nack)
+	serverMux.HandleFunc("/leave", Leave)
+	serverMux.HandleFunc("/reply/create", CreateReplyDest)
+	serverMux.HandleFunc("/stream/create", CreateStream)
+	serverMux.HandleFunc("/stream/delete", DeleteStream)
+	serverMux.HandleFunc("/stream/describe", DescribeStream)
+	serverMux.HandleFunc("/stream/append", AppendStream)
+	serverMux.HandleFunc("/stream/read", ReadStream)
+	serverMux.HandleFunc("/stream/commit", CommitStreamOffset)
+	serverMux.HandleFunc("/stream/seek", SeekStream)
+	serverMux.HandleFunc("/tx/begin", BeginTx)
+	serverMux.HandleFunc("/tx/put", TxPut)
+	serverMux.HandleFunc("/tx/commit", CommitTx)
+	serverMux.HandleFunc("/tx/abort", AbortTx)
+	serverMux.HandleFunc("/topic/subscribe", SubscribeTopic)
+	serverMux.HandleFunc("/topic/unsubscribe", UnsubscribeTopic)
+	serverMux.HandleFunc("/topic/publish", Publish)
+	serverMux.HandleFunc("/exchange/declare", DeclareExchange)
+	serverMux.HandleFunc("/exchange/delete", DeleteExchange)
+	serverMux.HandleFunc("/exchange/list", ListExchange)
+	serverMux.HandleFunc("/exchange/bind", BindExchange)
+	serverMux.HandleFunc("/exchange/unbind", UnbindExchange)
+	serverMux.HandleFunc("/exchange/publish", PublishExchange)
+	serverMux.HandleFunc("/deadletter/redrive", RedriveDeadLetter)
+	serverMux.HandleFunc("/admin/list", ListDest)
+	serverMux.HandleFunc("/admin/describe", DescribeDest)
+	serverMux.HandleFunc("/admin/delete", DeleteDest)
+	serverMux.HandleFunc("/admin/purge", PurgeDest)
+	serverMux.HandleFunc("/admin/capacity", SetDestCapacity)
+	serverMux.HandleFunc("/metrics", Metrics)
+	return serverMux
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	defaultExpireSweepInterval = 1 * time.Second
+)
+
+// scheduleHeap 按投递时间排序的延迟消息最小堆，所有延迟消息共用 broker 的后台巡检协程，
+// 不会为每条消息创建定时器或协程
+type scheduleHeap []*message
+
+func (h scheduleHeap) Len() int {
+	return len(h)
+}
+
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].DeliverAt.Equal(*h[j].DeliverAt) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].DeliverAt.Before(*h[j].DeliverAt)
+}
+
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	*h = append(*h, x.(*message))
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return m
+}
+
+// enqueue 将消息加入队尾，投递时间未到的消息加入延迟堆，调用方需持有锁
+func (q *Queue) enqueue(m *message, now time.Time) {
+	q.bytes += int64(len(m.Body))
+	if m.DeliverAt != nil && m.DeliverAt.After(now) {
+		heap.Push(&q.scheduled, m)
+		return
+	}
+	q.ready.PushBack(m)
+	q.notify()
+}
+
+// promoteDue 将投递时间已到的延迟消息移入队尾，调用方需持有锁
+func (q *Queue) promoteDue(now time.Time) {
+	for q.scheduled.Len() > 0 && !q.scheduled[0].DeliverAt.After(now) {
+		q.ready.PushBack(heap.Pop(&q.scheduled).(*message))
+		q.notify()
+	}
+}
+
+// tick 由后台巡检协程定期调用，释放租约过期的消息、投放到期的延迟消息，
+// 并以 defaultExpireSweepInterval 为间隔清理过期的消息
+func (q *Queue) tick(now time.Time) {
+	q.Lock()
+	defer q.unlock()
+	q.releaseExpired(now)
+	q.promoteDue(now)
+	if now.After(q.nextSweepAt) {
+		q.sweepExpired(now)
+		q.nextSweepAt = now.Add(defaultExpireSweepInterval)
+	}
+}
+
+// startSweeper 启动后台巡检协程，定期巡检所有 destination 的所有消费组，并删除所有者已离开的临时 destination
+func startSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			TxMap.expire(now)
+			for _, s := range StreamMap.List() {
+				s.tick(now)
+			}
+			for _, dest := range DestinationMap.List() {
+				for _, g := range dest.Groups() {
+					g.tick(now)
+				}
+				if dest.orphaned() {
+					removeReplyDest(dest)
+				}
+			}
+		}
+	}()
+}
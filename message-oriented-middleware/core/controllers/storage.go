@@ -1,27 +1,172 @@
 package controllers
 
-import "sync"
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
 
-type QueueMap struct {
-	keyMQueue map[string]*Queue
-	mutex     sync.RWMutex
+	"github.com/sirupsen/logrus"
+)
+
+// DestMap 保存所有的 destination
+type DestMap struct {
+	keyMDest map[string]*Destination
+	mutex    sync.RWMutex
+}
+
+func NewDestMap() *DestMap {
+	return &DestMap{
+		keyMDest: make(map[string]*Destination),
+	}
+}
+
+// GetOrAdd 返回 key 对应的 destination，不存在时使用 opts 创建
+func (dm *DestMap) GetOrAdd(key string, opts DestOptions) (*Destination, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dest, ok := dm.keyMDest[key]
+	if ok {
+		return dest, nil
+	}
+	return dm.add(key, opts)
+}
+
+// Add 创建 key 对应的 destination，已存在时返回 DestExistsError
+func (dm *DestMap) Add(key string, opts DestOptions) (*Destination, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if _, ok := dm.keyMDest[key]; ok {
+		return nil, &DestExistsError{DestName: key}
+	}
+	return dm.add(key, opts)
+}
+
+// DestExistsError 创建的 destination 已存在
+type DestExistsError struct {
+	DestName string
+}
+
+func (e *DestExistsError) Error() string {
+	return fmt.Sprintf("dest name %s already exists", e.DestName)
+}
+
+// add 创建 destination 并保存其配置，调用方需持有锁
+func (dm *DestMap) add(key string, opts DestOptions) (*Destination, error) {
+	dest := NewDestination(key, opts)
+	err := saveMeta(filepath.Join(encodeDirName(key), metaFileName), dest.opts)
+	if err != nil {
+		return nil, err
+	}
+	dm.keyMDest[key] = dest
+	return dest, nil
 }
 
-func NewQueueMap() *QueueMap {
-	return &QueueMap{
-		keyMQueue: make(map[string]*Queue),
+// Register 注册 key 对应的 destination，已存在且配置兼容时直接返回，返回值 created 表示是否新建了 destination。
+// 配置冲突时返回 OptionsConflictError，force 为 true 时删除已有的 destination 及其所有消息后重新创建。
+// 新建的 destination 中未指定的配置使用匹配的模板补全，死信 destination 链回到自身时返回 DeadLetterCycleError
+func (dm *DestMap) Register(key string, opts DestOptions, force bool) (dest *Destination, created bool, err error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dest, ok := dm.keyMDest[key]
+	var fields []string
+	if ok {
+		fields = opts.conflicts(dest.Options())
+		if len(fields) == 0 {
+			return dest, false, nil
+		}
+		if !force {
+			return nil, false, &OptionsConflictError{DestName: key, Fields: fields}
+		}
 	}
+	opts = templateOptions(key, opts)
+	if dm.deadLetterCycle(key, opts.DeadLetterDest) {
+		return nil, false, &DeadLetterCycleError{DestName: key, DeadLetterDest: opts.DeadLetterDest}
+	}
+	if ok {
+		logrus.WithField("destName", key).WithField("fields", fields).
+			Warnf("force recreate destination, all its messages are discarded")
+		delete(dm.keyMDest, key)
+		err = dest.Remove()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	dest, err = dm.add(key, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	return dest, true, nil
 }
 
-func (qm *QueueMap) Add(key string, queue *Queue) {
-	qm.mutex.Lock()
-	defer qm.mutex.Unlock()
-	qm.keyMQueue[key] = queue
+// deadLetterCycle 判断从 deadLetterDest 开始沿死信 destination 链是否会回到 key，调用方需持有锁。
+// 尚不存在的死信 destination 使用匹配的模板中的配置，与转入死信时自动创建的配置一致
+func (dm *DestMap) deadLetterCycle(key, deadLetterDest string) bool {
+	visited := make(map[string]bool)
+	for name := deadLetterDest; name != ""; {
+		if name == key {
+			return true
+		}
+		if visited[name] {
+			return false
+		}
+		visited[name] = true
+		if dest, ok := dm.keyMDest[name]; ok {
+			name = dest.Options().DeadLetterDest
+		} else {
+			name = templateOptions(name, DestOptions{}).DeadLetterDest
+		}
+	}
+	return false
 }
 
-func (qm *QueueMap) Get(key string) (*Queue, bool) {
-	qm.mutex.RLock()
-	defer qm.mutex.RUnlock()
-	queue, ok := qm.keyMQueue[key]
-	return queue, ok
+// DeadLetterCycleError 死信 destination 链最终回到 destination 自身，死信消息会在其中循环转发
+type DeadLetterCycleError struct {
+	DestName       string
+	DeadLetterDest string
+}
+
+func (e *DeadLetterCycleError) Error() string {
+	return fmt.Sprintf("dead letter dest %s of dest name %s leads back to itself", e.DeadLetterDest, e.DestName)
+}
+
+// Delete 删除 key 对应的 destination 及其所有消息
+func (dm *DestMap) Delete(key string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dest, ok := dm.keyMDest[key]
+	if !ok {
+		return fmt.Errorf("unknown dest name %s", key)
+	}
+	delete(dm.keyMDest, key)
+	return dest.Remove()
+}
+
+func (dm *DestMap) Get(key string) (*Destination, bool) {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	dest, ok := dm.keyMDest[key]
+	return dest, ok
+}
+
+// List 返回所有 destination
+func (dm *DestMap) List() []*Destination {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	dests := make([]*Destination, 0, len(dm.keyMDest))
+	for _, dest := range dm.keyMDest {
+		dests = append(dests, dest)
+	}
+	return dests
+}
+
+// Close 关闭所有 destination
+func (dm *DestMap) Close() {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	for key, dest := range dm.keyMDest {
+		err := dest.Close()
+		if err != nil {
+			logrus.WithField("key", key).Errorf("failed to close destination, error = %v", err)
+		}
+	}
 }
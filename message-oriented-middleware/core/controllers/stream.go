@@ -0,0 +1,707 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"technology/message-oriented-middleware/comm"
+	"technology/message-oriented-middleware/core/wal"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// seek 的目标位置
+const (
+	// SeekBeginning 最早保留的消息
+	SeekBeginning = "beginning"
+	// SeekEnd 下一条写入的消息
+	SeekEnd = "end"
+	// SeekTimestamp 第一条写入时间不早于指定时间的消息
+	SeekTimestamp = "timestamp"
+
+	streamsDirName    = "streams"
+	streamLogDirName  = "log"
+	offsetsFileName   = "offsets.json"
+	defaultStreamRead = 100
+)
+
+var (
+	StreamMap = NewStreams()
+)
+
+// StreamOptions stream 的保留策略，创建时持久化到 stream 目录下的 meta.json 中
+type StreamOptions struct {
+	// RetentionSeconds 消息保留的秒数，为 0 时不按时间清理
+	RetentionSeconds int `json:"retentionSeconds,omitempty"`
+	// RetentionBytes 保留的消息内容总字节数上限，超过后从最早的消息开始清理，为 0 时不限制
+	RetentionBytes int64 `json:"retentionBytes,omitempty"`
+}
+
+func (o StreamOptions) validate() error {
+	if o.RetentionSeconds < 0 || o.RetentionBytes < 0 {
+		return fmt.Errorf("retentionSeconds and retentionBytes can not be negative")
+	}
+	return nil
+}
+
+// StreamConflictError 重复创建 stream 时指定的保留策略与已有的不一致
+type StreamConflictError struct {
+	Stream string
+	Fields []string
+}
+
+func (e *StreamConflictError) Error() string {
+	return fmt.Sprintf("stream %s already exists with different %s", e.Stream, strings.Join(e.Fields, ", "))
+}
+
+// Stream 追加写的消息日志，消费不会删除消息，消息按保留策略清理。
+// 每条消息拥有单调递增的 offset，各消费组在 broker 上提交自己的消费位置，可以 seek 到任意位置重新消费
+type Stream struct {
+	mutex   sync.Mutex
+	name    string
+	opts    StreamOptions
+	records []*streamRecord
+	bytes   int64
+	// start 最早保留的消息的 offset，没有消息时与 end 相同
+	start int64
+	// end 下一条写入的消息的 offset
+	end int64
+	// offsets 各消费组提交的 offset，即下一条要消费的消息
+	offsets   map[string]int64
+	log       *wal.Log
+	available *broadcast
+}
+
+// streamRecord stream 中的消息，持久化时以 json 格式写入预写日志，offset 为预写日志中的序号
+type streamRecord struct {
+	offset    int64
+	Timestamp time.Time `json:"timestamp"`
+	Payload
+}
+
+// Streams 保存所有的 stream，stream 与 destination 使用各自的名称空间
+type Streams struct {
+	mutex   sync.RWMutex
+	streams map[string]*Stream
+}
+
+func NewStreams() *Streams {
+	return &Streams{
+		streams: make(map[string]*Stream),
+	}
+}
+
+// Create 创建 stream，已存在且保留策略兼容时直接返回，返回值 created 表示是否新建了 stream，
+// 保留策略冲突时返回 StreamConflictError
+func (ss *Streams) Create(name string, opts StreamOptions) (*Stream, bool, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if s, ok := ss.streams[name]; ok {
+		var fields []string
+		if opts.RetentionSeconds != 0 && opts.RetentionSeconds != s.opts.RetentionSeconds {
+			fields = append(fields, "retentionSeconds")
+		}
+		if opts.RetentionBytes != 0 && opts.RetentionBytes != s.opts.RetentionBytes {
+			fields = append(fields, "retentionBytes")
+		}
+		if len(fields) > 0 {
+			return nil, false, &StreamConflictError{Stream: name, Fields: fields}
+		}
+		return s, false, nil
+	}
+	err := saveMeta(filepath.Join(streamsDirName, encodeDirName(name), metaFileName), opts)
+	if err != nil {
+		return nil, false, err
+	}
+	s, err := openStream(name, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	ss.streams[name] = s
+	return s, true, nil
+}
+
+// Get 返回 name 对应的 stream
+func (ss *Streams) Get(name string) (*Stream, bool) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+	s, ok := ss.streams[name]
+	return s, ok
+}
+
+// List 返回所有的 stream
+func (ss *Streams) List() []*Stream {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+	streams := make([]*Stream, 0, len(ss.streams))
+	for _, s := range ss.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// Delete 删除 stream 及其所有消息与消费位置
+func (ss *Streams) Delete(name string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	s, ok := ss.streams[name]
+	if !ok {
+		return fmt.Errorf("unknown stream %s", name)
+	}
+	delete(ss.streams, name)
+	return s.remove()
+}
+
+// openStream 创建 stream，配置了 DataDir 时从预写日志中恢复保留的消息与各消费组的消费位置
+func openStream(name string, opts StreamOptions) (*Stream, error) {
+	s := &Stream{
+		name:      name,
+		opts:      opts,
+		offsets:   make(map[string]int64),
+		available: newBroadcast(),
+	}
+	if brokerOptions.DataDir == "" {
+		return s, nil
+	}
+	dir := streamDir(name)
+	err := loadJSON(filepath.Join(dir, offsetsFileName), &s.offsets)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	log, records, err := wal.Open(filepath.Join(dir, streamLogDirName), brokerOptions.WAL)
+	if err != nil {
+		return nil, err
+	}
+	s.log = log
+	for _, r := range records {
+		record := new(streamRecord)
+		err := json.Unmarshal(r.Data, record)
+		if err != nil {
+			// 保留一条空消息占位，保证 offset 连续
+			logrus.WithField("stream", name).WithField("offset", r.Seq).
+				Errorf("failed to unmarshal stream record, error = %v", err)
+			record = new(streamRecord)
+		}
+		record.offset = int64(r.Seq)
+		s.records = append(s.records, record)
+		s.bytes += int64(len(record.Body))
+	}
+	s.end = int64(log.NextSeq())
+	s.start = s.end
+	if len(s.records) > 0 {
+		s.start = s.records[0].offset
+	}
+	return s, nil
+}
+
+// Append 在 stream 末尾写入消息，返回消息的 offset
+func (s *Stream) Append(payload Payload) (*streamRecord, error) {
+	if s.opts.RetentionBytes > 0 && int64(len(payload.Body)) > s.opts.RetentionBytes {
+		return nil, fmt.Errorf("message exceeds the retentionBytes of stream %s", s.name)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := &streamRecord{offset: s.end, Timestamp: time.Now(), Payload: payload}
+	if s.log != nil {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		seq, err := s.log.Append(data)
+		if err != nil {
+			return nil, err
+		}
+		record.offset = int64(seq)
+	}
+	s.records = append(s.records, record)
+	s.bytes += int64(len(record.Body))
+	s.end = record.offset + 1
+	s.trim(record.Timestamp)
+	s.available.notify()
+	return record, nil
+}
+
+// trim 按保留策略从最早的消息开始清理，并在预写日志中确认被清理的消息，调用方需持有锁
+func (s *Stream) trim(now time.Time) {
+	retention := time.Duration(s.opts.RetentionSeconds) * time.Second
+	for len(s.records) > 0 {
+		r := s.records[0]
+		expired := s.opts.RetentionSeconds > 0 && now.Sub(r.Timestamp) >= retention
+		oversize := s.opts.RetentionBytes > 0 && s.bytes > s.opts.RetentionBytes
+		if !expired && !oversize {
+			return
+		}
+		s.records[0] = nil
+		s.records = s.records[1:]
+		s.bytes -= int64(len(r.Body))
+		s.start = r.offset + 1
+		if s.log == nil {
+			continue
+		}
+		err := s.log.Ack(uint64(r.offset))
+		if err != nil {
+			logrus.WithField("stream", s.name).WithField("offset", r.offset).
+				Errorf("failed to ack trimmed record in wal, error = %v", err)
+		}
+	}
+}
+
+// tick 由后台巡检协程定期调用，清理超过保留时间的消息
+func (s *Stream) tick(now time.Time) {
+	if s.opts.RetentionSeconds <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	s.trim(now)
+	s.mutex.Unlock()
+}
+
+// Read 从 offset 开始最多读取 max 条消息，返回下一次读取的 offset。
+// offset 早于最早保留的消息时从最早的消息开始读取，offset 等于 end 时等待新的消息，ctx 结束时返回空
+func (s *Stream) Read(ctx context.Context, offset int64, max int) ([]*streamRecord, int64, error) {
+	for {
+		s.mutex.Lock()
+		if offset < 0 || offset > s.end {
+			end := s.end
+			s.mutex.Unlock()
+			return nil, offset, fmt.Errorf("offset %d of stream %s is out of range [0, %d]", offset, s.name, end)
+		}
+		if offset < s.start {
+			offset = s.start
+		}
+		i := s.search(offset)
+		if i < len(s.records) {
+			n := len(s.records) - i
+			if n > max {
+				n = max
+			}
+			records := make([]*streamRecord, n)
+			copy(records, s.records[i:i+n])
+			s.mutex.Unlock()
+			return records, records[n-1].offset + 1, nil
+		}
+		available := s.available.channel()
+		s.mutex.Unlock()
+		if !wait(ctx, available, time.Time{}) {
+			return nil, offset, nil
+		}
+	}
+}
+
+// search 返回第一条 offset 不小于 offset 的消息的下标，调用方需持有锁。
+// 预写日志中的序号可能不连续，不能通过 offset 与 start 的差值计算下标
+func (s *Stream) search(offset int64) int {
+	return sort.Search(len(s.records), func(i int) bool {
+		return s.records[i].offset >= offset
+	})
+}
+
+// position 返回消费组的消费位置，消费组第一次读取时从下一条写入的消息开始
+func (s *Stream) position(group string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset, ok := s.offsets[group]; ok {
+		return offset, nil
+	}
+	return s.end, s.setOffset(group, s.end)
+}
+
+// Commit 提交消费组的消费位置，offset 为下一条要消费的消息
+func (s *Stream) Commit(group string, offset int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset < 0 || offset > s.end {
+		return fmt.Errorf("offset %d of stream %s is out of range [0, %d]", offset, s.name, s.end)
+	}
+	return s.setOffset(group, offset)
+}
+
+// Seek 将消费组的消费位置移动到 position，返回移动后的 offset
+func (s *Stream) Seek(group, position string, timestamp *time.Time) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var offset int64
+	switch position {
+	case SeekBeginning:
+		offset = s.start
+	case SeekEnd:
+		offset = s.end
+	case SeekTimestamp:
+		if timestamp == nil {
+			return 0, fmt.Errorf("timestamp is required when seek to %s", SeekTimestamp)
+		}
+		i := sort.Search(len(s.records), func(i int) bool {
+			return !s.records[i].Timestamp.Before(*timestamp)
+		})
+		offset = s.end
+		if i < len(s.records) {
+			offset = s.records[i].offset
+		}
+	default:
+		return 0, fmt.Errorf("unknown seek position %s, must be one of %s, %s, %s",
+			position, SeekBeginning, SeekEnd, SeekTimestamp)
+	}
+	return offset, s.setOffset(group, offset)
+}
+
+// setOffset 记录并持久化消费组的消费位置，调用方需持有锁
+func (s *Stream) setOffset(group string, offset int64) error {
+	offsets := make(map[string]int64, len(s.offsets)+1)
+	for g, o := range s.offsets {
+		offsets[g] = o
+	}
+	offsets[group] = offset
+	err := saveMeta(filepath.Join(streamsDirName, encodeDirName(s.name), offsetsFileName), offsets)
+	if err != nil {
+		return err
+	}
+	s.offsets = offsets
+	return nil
+}
+
+// Info 返回 stream 的保留范围与各消费组的消费位置
+func (s *Stream) Info() StreamInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := StreamInfo{
+		Name:        s.name,
+		Options:     s.opts,
+		StartOffset: s.start,
+		EndOffset:   s.end,
+		Messages:    len(s.records),
+		Bytes:       s.bytes,
+	}
+	for group, offset := range s.offsets {
+		// offset 可能不连续，按实际保留的消息计算积压
+		lag := int64(len(s.records) - s.search(offset))
+		info.Groups = append(info.Groups, StreamGroupInfo{Name: group, Offset: offset, Lag: lag})
+	}
+	sort.Slice(info.Groups, func(i, j int) bool {
+		return info.Groups[i].Name < info.Groups[j].Name
+	})
+	return info
+}
+
+// remove 关闭预写日志并删除 stream 的持久化数据
+func (s *Stream) remove() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	if err := s.log.Close(); err != nil {
+		logrus.WithField("stream", s.name).Errorf("failed to close wal before remove, error = %v", err)
+	}
+	return os.RemoveAll(streamDir(s.name))
+}
+
+func newStreamRecord(r *streamRecord) StreamRecord {
+	resp := StreamRecord{
+		Offset:      r.offset,
+		Timestamp:   r.Timestamp,
+		ContentType: r.ContentType,
+		Headers:     r.Headers,
+	}
+	resp.Msg, resp.Body = r.content()
+	return resp
+}
+
+// lookupStream 返回 name 对应的 stream，不存在时返回错误
+func lookupStream(name string) (*Stream, error) {
+	s, ok := StreamMap.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown stream %s", name)
+	}
+	return s, nil
+}
+
+// CreateStream 创建 stream
+var CreateStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept create stream request")
+	defer request.Body.Close()
+	v := new(CreateStreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	opts := StreamOptions{
+		RetentionSeconds: v.RetentionSeconds,
+		RetentionBytes:   v.RetentionBytes,
+	}
+	if v.Stream == "" {
+		err = fmt.Errorf("stream can not be empty")
+	} else {
+		err = opts.validate()
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	s, created, err := StreamMap.Create(v.Stream, opts)
+	if conflict, ok := err.(*StreamConflictError); ok {
+		ServeJSON(writer, http.StatusConflict, comm.ResponseData{
+			Err: conflict.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "create stream success",
+		Data: CreateStreamResp{Options: s.opts, Created: created},
+	})
+}
+
+// DeleteStream 删除 stream 及其所有消息
+var DeleteStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept delete stream request")
+	defer request.Body.Close()
+	v := new(StreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	if _, err := lookupStream(v.Stream); err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	err = StreamMap.Delete(v.Stream)
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "delete stream success",
+	})
+}
+
+// DescribeStream 查看 stream 保留的消息范围与各消费组的消费位置
+var DescribeStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept describe stream request")
+	defer request.Body.Close()
+	v := new(StreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	s, err := lookupStream(v.Stream)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "describe stream success",
+		Data: s.Info(),
+	})
+}
+
+// AppendStream 向 stream 写入消息
+var AppendStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept append stream request")
+	defer request.Body.Close()
+	v := new(AppendStreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	s, err := lookupStream(v.Stream)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	payload, err := newPayload(v.Msg, v.Body, v.ContentType, v.Headers)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	record, err := s.Append(payload)
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "append stream success",
+		Data: AppendStreamResp{Offset: record.offset, Timestamp: record.Timestamp},
+	})
+}
+
+// ReadStream 从指定的 offset 或消费组的消费位置读取消息，读取不会移动消费位置，
+// 消费者处理完成后需要通过 /stream/commit 提交
+var ReadStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept read stream request")
+	defer request.Body.Close()
+	v := new(ReadStreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.Max < 0 || v.Max > maxBatchSize {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("max must be in [0, %d]", maxBatchSize),
+		})
+		return
+	}
+	max := v.Max
+	if max == 0 {
+		max = defaultStreamRead
+	}
+
+	s, err := lookupStream(v.Stream)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	var offset int64
+	if v.Offset != nil {
+		offset = *v.Offset
+	} else {
+		offset, err = s.position(groupName(v.Group))
+		if err != nil {
+			ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+				Err: err.Error(),
+			})
+			return
+		}
+	}
+
+	ctx := request.Context()
+	if v.WaitSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(v.WaitSeconds)*time.Second)
+		defer cancel()
+	}
+	records, next, err := s.Read(ctx, offset, max)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if len(records) == 0 {
+		if request.Context().Err() != nil {
+			logrus.WithField("stream", v.Stream).Infof("reader gone before any message arrived")
+			return
+		}
+		ServeJSON(writer, http.StatusOK, comm.ResponseData{
+			Msg:  "no message arrived before wait timeout",
+			Data: ReadStreamResp{NextOffset: next, TimedOut: true},
+		})
+		return
+	}
+	resp := ReadStreamResp{Records: make([]StreamRecord, len(records)), NextOffset: next}
+	for i, r := range records {
+		resp.Records[i] = newStreamRecord(r)
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "read stream success",
+		Data: resp,
+	})
+}
+
+// CommitStreamOffset 提交消费组的消费位置
+var CommitStreamOffset http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept commit stream offset request")
+	defer request.Body.Close()
+	v := new(CommitStreamOffsetReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	s, err := lookupStream(v.Stream)
+	if err == nil {
+		err = s.Commit(groupName(v.Group), v.Offset)
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "commit stream offset success",
+	})
+}
+
+// SeekStream 将消费组的消费位置移动到最早的消息、末尾或指定的时间，用于重新消费历史消息
+var SeekStream http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept seek stream request")
+	defer request.Body.Close()
+	v := new(SeekStreamReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	s, err := lookupStream(v.Stream)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	offset, err := s.Seek(groupName(v.Group), v.Position, v.Timestamp)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	logrus.WithField("stream", v.Stream).WithField("group", v.Group).Infof("seek to offset %d", offset)
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "seek stream success",
+		Data: SeekStreamResp{Offset: offset},
+	})
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+)
+
+// newGappedStream 构造 offset 不连续的 stream，模拟预写日志中的序号空洞
+func newGappedStream(offsets ...int64) *Stream {
+	s := &Stream{name: "gapped", available: newBroadcast(), offsets: make(map[string]int64)}
+	for _, offset := range offsets {
+		s.records = append(s.records, &streamRecord{offset: offset})
+	}
+	s.start = offsets[0]
+	s.end = offsets[len(offsets)-1] + 1
+	return s
+}
+
+func TestStreamReadSkipsOffsetGaps(t *testing.T) {
+	s := newGappedStream(3, 4, 7, 8)
+	cases := []struct {
+		offset, next int64
+		max          int
+		want         []int64
+	}{
+		{offset: 0, max: 3, want: []int64{3, 4, 7}, next: 8},
+		{offset: 5, max: 10, want: []int64{7, 8}, next: 9},
+		{offset: 8, max: 10, want: []int64{8}, next: 9},
+	}
+	for _, c := range cases {
+		records, next, err := s.Read(context.Background(), c.offset, c.max)
+		if err != nil {
+			t.Fatalf("read from %d: %v", c.offset, err)
+		}
+		got := make([]int64, len(records))
+		for i, r := range records {
+			got[i] = r.offset
+		}
+		if len(got) != len(c.want) || next != c.next {
+			t.Errorf("read from %d = %v, next %d, want %v, next %d", c.offset, got, next, c.want, c.next)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("read from %d = %v, want %v", c.offset, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStreamLagSkipsOffsetGaps(t *testing.T) {
+	s := newGappedStream(3, 4, 7, 8)
+	s.offsets = map[string]int64{"behind": 0, "gap": 5, "middle": 7, "done": 9}
+	want := map[string]int64{"behind": 4, "gap": 2, "middle": 2, "done": 0}
+	for _, g := range s.Info().Groups {
+		if g.Lag != want[g.Name] {
+			t.Errorf("lag of group %s at offset %d = %d, want %d", g.Name, g.Offset, g.Lag, want[g.Name])
+		}
+	}
+}
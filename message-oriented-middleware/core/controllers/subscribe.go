@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSubscribeCredit = 10
+	ndjsonContentType      = "application/x-ndjson"
+)
+
+// Subscribe 建立长连接订阅，broker 在消息到达时以 NDJSON 的格式逐行推送 ConsumeResp，
+// 未确认的消息数达到 credit 后暂停推送，消费者通过 /ack 或 /nack 确认消息后恢复，
+// 客户端断开连接后订阅结束
+var Subscribe http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept subscribe request")
+	defer request.Body.Close()
+	v := new(SubscribeReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.Credit < 0 {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "credit can not be negative",
+		})
+		return
+	}
+	credit := v.Credit
+	if credit == 0 {
+		credit = defaultSubscribeCredit
+	}
+	// credit 按消费者统计未确认的消息数，未指定 ConsumerId 时为本次订阅生成一个
+	consumerId := v.ConsumerId
+	if consumerId == "" {
+		consumerId = uuid.New().String()
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: "streaming is not supported by the connection",
+		})
+		return
+	}
+	group, err := lookupConsumerGroup(v.DestName, v.Group, consumerId)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("subscribe a unknown dest name or group, %v", err),
+		})
+		return
+	}
+
+	visibility := defaultVisibilityTimeout
+	if v.VisibilityTimeout > 0 {
+		visibility = time.Duration(v.VisibilityTimeout) * time.Second
+	}
+
+	writer.Header().Set("Content-Type", ndjsonContentType)
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := request.Context()
+	encoder := json.NewEncoder(writer)
+	logger := logrus.WithField("destName", v.DestName).WithField("consumerId", consumerId)
+	for {
+		d := group.Get(ctx, consumerId, credit, visibility)
+		if d == nil {
+			logger.Infof("subscription closed by consumer")
+			return
+		}
+		err = encoder.Encode(newConsumeResp(d))
+		if err != nil {
+			// 消息没有送达消费者，立即释放以便重新投递
+			group.Nack(d.Id, d.Lease, fmt.Sprintf("failed to push message to subscriber, %v", err))
+			logger.Errorf("failed to push message, close subscription, error = %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DestTemplate 按名称匹配 destination 的配置模板，Pattern 使用 path.Match 的语法，例如 orders.*
+type DestTemplate struct {
+	Pattern string      `json:"pattern"`
+	Options DestOptions `json:"options"`
+	// Groups 自动创建 destination 时一并创建的消费组，为空时只创建默认消费组。
+	// 消费组只能收到创建之后生产的消息，生产者先于消费者启动时，需要在这里列出消费者使用的消费组
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Config broker 的配置文件
+type Config struct {
+	// Templates 按顺序匹配，使用第一个匹配的模板。生产者向不存在且匹配模板的 destination 生产消息时自动创建该 destination，
+	// 注册 destination 与订阅 topic 时未指定的配置也使用模板中的配置
+	Templates []DestTemplate `json:"templates,omitempty"`
+}
+
+// LoadConfig 读取 json 格式的配置文件
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s, error = %v", file, err)
+	}
+	return config, nil
+}
+
+func validateTemplates(templates []DestTemplate) error {
+	for _, t := range templates {
+		if _, err := path.Match(t.Pattern, ""); err != nil || t.Pattern == "" {
+			return fmt.Errorf("invalid dest template pattern %q", t.Pattern)
+		}
+		if err := t.Options.validate(); err != nil {
+			return fmt.Errorf("invalid options of dest template %s, %v", t.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchTemplate 返回第一个与 destName 匹配的模板
+func matchTemplate(destName string) (*DestTemplate, bool) {
+	for i := range brokerOptions.Templates {
+		t := &brokerOptions.Templates[i]
+		if ok, _ := path.Match(t.Pattern, destName); ok {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// templateOptions 使用匹配的模板补全 opts 中未指定的配置
+func templateOptions(destName string, opts DestOptions) DestOptions {
+	t, ok := matchTemplate(destName)
+	if !ok {
+		return opts
+	}
+	base := t.Options
+	if opts.Capacity == 0 {
+		opts.Capacity = base.Capacity
+	}
+	if opts.MaxDeliveries == 0 {
+		opts.MaxDeliveries = base.MaxDeliveries
+	}
+	if opts.DeadLetterDest == "" {
+		opts.DeadLetterDest = base.DeadLetterDest
+	}
+	if opts.TTLSeconds == 0 {
+		opts.TTLSeconds = base.TTLSeconds
+	}
+	if opts.DeadLetterExpired == nil {
+		opts.DeadLetterExpired = base.DeadLetterExpired
+	}
+	if opts.MaxPriority == 0 {
+		opts.MaxPriority = base.MaxPriority
+	}
+	if opts.StarvationSeconds == 0 {
+		opts.StarvationSeconds = base.StarvationSeconds
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = base.MaxBytes
+	}
+	if opts.DedupWindowSeconds == 0 {
+		opts.DedupWindowSeconds = base.DedupWindowSeconds
+	}
+	if opts.DedupMaxEntries == 0 {
+		opts.DedupMaxEntries = base.DedupMaxEntries
+	}
+	if opts.Partitions == 0 {
+		opts.Partitions = base.Partitions
+	}
+	if opts.OverflowPolicy == "" {
+		opts.OverflowPolicy = base.OverflowPolicy
+		if opts.BlockTimeoutSeconds == 0 {
+			opts.BlockTimeoutSeconds = base.BlockTimeoutSeconds
+		}
+	}
+	return opts
+}
+
+// productDest 返回生产消息的 destination，destination 不存在但匹配模板时使用模板自动创建，
+// 并创建模板中的消费组（未指定时为默认消费组）保存消费者注册之前生产的消息。ok 为 false 时表示 destination 不存在
+func productDest(destName string) (dest *Destination, ok bool, err error) {
+	dest, ok = DestinationMap.Get(destName)
+	if ok {
+		return dest, true, nil
+	}
+	t, ok := matchTemplate(destName)
+	if !ok || destName == "" {
+		return nil, false, nil
+	}
+	dest, err = DestinationMap.GetOrAdd(destName, t.Options)
+	if err != nil {
+		return nil, true, err
+	}
+	groups := t.Groups
+	if len(groups) == 0 {
+		groups = []string{DefaultGroup}
+	}
+	for _, group := range groups {
+		_, err = dest.Join(group, "")
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	logrus.WithField("destName", destName).WithField("pattern", t.Pattern).WithField("groups", groups).
+		Infof("auto create destination from template")
+	return dest, true, nil
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+)
+
+// withTemplates 在测试期间使用 templates 作为 broker 的配置模板
+func withTemplates(t *testing.T, templates []DestTemplate) {
+	saved := brokerOptions.Templates
+	brokerOptions.Templates = templates
+	t.Cleanup(func() {
+		brokerOptions.Templates = saved
+	})
+}
+
+// autoCreate 通过生产消息自动创建 destination，并在测试结束时删除
+func autoCreate(t *testing.T, destName string) *Destination {
+	dest, ok, err := productDest(destName)
+	if !ok || err != nil {
+		t.Fatalf("productDest(%s) = %v, %v, want auto created destination", destName, ok, err)
+	}
+	t.Cleanup(func() {
+		DestinationMap.Delete(destName)
+	})
+	return dest
+}
+
+func TestProductDestCreatesTemplateGroups(t *testing.T) {
+	withTemplates(t, []DestTemplate{{Pattern: "orders.*", Groups: []string{"billing", "audit"}}})
+	dest := autoCreate(t, "orders.created")
+	if _, err := dest.Put(context.Background(), textMessages("early", 1)[0]); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// 消费者之后才加入模板中声明的消费组，仍能收到加入之前生产的消息
+	for _, group := range []string{"billing", "audit"} {
+		g, err := dest.Join(group, "consumer-"+group)
+		if err != nil {
+			t.Fatalf("join %s: %v", group, err)
+		}
+		if n := queueSize(g.partitions[0]); n != 1 {
+			t.Errorf("messages in group %s = %d, want 1", group, n)
+		}
+	}
+	if _, err := dest.Group(DefaultGroup); err == nil {
+		t.Error("default group created although the template declares groups")
+	}
+}
+
+func TestProductDestCreatesDefaultGroup(t *testing.T) {
+	withTemplates(t, []DestTemplate{{Pattern: "events.*"}})
+	dest := autoCreate(t, "events.created")
+	if _, err := dest.Put(context.Background(), textMessages("early", 1)[0]); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if n := queueSize(queueOf(t, dest, DefaultGroup, 0)); n != 1 {
+		t.Fatalf("messages in default group = %d, want 1", n)
+	}
+
+	// 没有在模板中声明的消费组只能收到加入之后生产的消息
+	g, err := dest.Join("late", "consumer")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if n := queueSize(g.partitions[0]); n != 0 {
+		t.Fatalf("messages in group created after produce = %d, want 0", n)
+	}
+}
+
+func TestProductDestWithoutTemplate(t *testing.T) {
+	withTemplates(t, nil)
+	if _, ok, _ := productDest("no-template"); ok {
+		t.Fatal("productDest created a destination without matching template")
+	}
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	TopicMap = NewTopics()
+)
+
+// Topics 保存 topic 与订阅的绑定关系，每个订阅都是一个独立的 destination，
+// 拥有自己的积压消息与容量，发布到 topic 的消息会复制到所有订阅中
+type Topics struct {
+	mutex  sync.RWMutex
+	topics map[string]map[string]struct{}
+}
+
+func NewTopics() *Topics {
+	return &Topics{
+		topics: make(map[string]map[string]struct{}),
+	}
+}
+
+// Subscribe 创建订阅并绑定到 topic，订阅已存在时只绑定，同一个订阅可以绑定到多个 topic。
+// 同名的 destination 已存在但不是任何 topic 的订阅时返回 SubscriptionConflictError，不会接管该 destination
+func (t *Topics) Subscribe(topic, subscription string, opts DestOptions) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	dest, ok := DestinationMap.Get(subscription)
+	if ok && !t.subscribed(subscription) {
+		return &SubscriptionConflictError{Subscription: subscription}
+	}
+	var err error
+	if !ok {
+		dest, err = DestinationMap.Add(subscription, templateOptions(subscription, opts))
+		if _, exists := err.(*DestExistsError); exists {
+			return &SubscriptionConflictError{Subscription: subscription}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dest.Join(DefaultGroup, "")
+	if err != nil {
+		return err
+	}
+	subs, ok := t.topics[topic]
+	if !ok {
+		subs = make(map[string]struct{})
+		t.topics[topic] = subs
+	}
+	subs[subscription] = struct{}{}
+	return t.save()
+}
+
+// SubscriptionConflictError 订阅与已有的普通 destination 同名
+type SubscriptionConflictError struct {
+	Subscription string
+}
+
+func (e *SubscriptionConflictError) Error() string {
+	return fmt.Sprintf("dest name %s already exists and is not a subscription of any topic", e.Subscription)
+}
+
+// Unsubscribe 解除订阅与 topic 的绑定，订阅没有绑定到其他 topic 时删除订阅及其积压的消息
+func (t *Topics) Unsubscribe(topic, subscription string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	subs, ok := t.topics[topic]
+	if !ok {
+		return fmt.Errorf("unknown topic %s", topic)
+	}
+	if _, ok := subs[subscription]; !ok {
+		return fmt.Errorf("unknown subscription %s of topic %s", subscription, topic)
+	}
+	delete(subs, subscription)
+	err := t.save()
+	if err != nil {
+		return err
+	}
+	if t.subscribed(subscription) {
+		return nil
+	}
+	return DestinationMap.Delete(subscription)
+}
+
+// Subscriptions 返回 topic 的所有订阅
+func (t *Topics) Subscriptions(topic string) ([]string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	subs, ok := t.topics[topic]
+	if !ok {
+		return nil, false
+	}
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// subscribedBy 返回订阅了 subscription 的 topic
+func (t *Topics) subscribedBy(subscription string) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.topicOf(subscription)
+}
+
+// subscribed 判断 subscription 是否绑定到任一 topic，调用方需持有锁
+func (t *Topics) subscribed(subscription string) bool {
+	_, ok := t.topicOf(subscription)
+	return ok
+}
+
+// topicOf 返回订阅了 subscription 的 topic，调用方需持有锁
+func (t *Topics) topicOf(subscription string) (string, bool) {
+	for topic, subs := range t.topics {
+		if _, ok := subs[subscription]; ok {
+			return topic, true
+		}
+	}
+	return "", false
+}
+
+// Publish 将消息复制到 topic 的所有订阅中，所有订阅中的消息使用同一个 id，并使用各个订阅默认的存活时间
+func (t *Topics) Publish(ctx context.Context, topic string, payload Payload) (*PublishResp, error) {
+	subs, ok := t.Subscriptions(topic)
+	if !ok {
+		return nil, fmt.Errorf("publish msg to a unknown topic %s", topic)
+	}
+	resp := &PublishResp{Id: uuid.New().String()}
+	now := time.Now()
+	for _, sub := range subs {
+		dest, ok := DestinationMap.Get(sub)
+		if !ok {
+			resp.addFailed(sub, fmt.Errorf("unknown dest name %s", sub))
+			continue
+		}
+		m := message{Id: resp.Id, Payload: payload}
+		dest.defaultExpireAt(&m, now)
+		err := dest.putMessages(ctx, []message{m}, true)
+		if err != nil {
+			resp.addFailed(sub, err)
+			continue
+		}
+		resp.Delivered++
+	}
+	return resp, nil
+}
+
+// save 持久化 topic 与订阅的绑定关系，调用方需持有锁
+func (t *Topics) save() error {
+	topics := make(map[string][]string, len(t.topics))
+	for topic := range t.topics {
+		for sub := range t.topics[topic] {
+			topics[topic] = append(topics[topic], sub)
+		}
+		if _, ok := topics[topic]; !ok {
+			topics[topic] = []string{}
+		}
+	}
+	return saveMeta(topicsFileName, topics)
+}
+
+func (t *Topics) restore(topics map[string][]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for topic, subs := range topics {
+		t.topics[topic] = make(map[string]struct{})
+		for _, sub := range subs {
+			t.topics[topic][sub] = struct{}{}
+		}
+	}
+}
+
+func (r *PublishResp) addFailed(subscription string, err error) {
+	if r.Failed == nil {
+		r.Failed = make(map[string]string)
+	}
+	r.Failed[subscription] = err.Error()
+	logrus.WithField("subscription", subscription).Errorf("failed to publish msg to subscription, error = %v", err)
+}
+
+// 订阅 topic
+var SubscribeTopic http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept subscribe topic request")
+	defer request.Body.Close()
+	v := new(SubscribeTopicReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if v.Topic == "" || v.Subscription == "" {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: "topic and subscription are required",
+		})
+		return
+	}
+
+	err = TopicMap.Subscribe(v.Topic, v.Subscription, DestOptions{Capacity: v.Capacity})
+	if conflict, ok := err.(*SubscriptionConflictError); ok {
+		ServeJSON(writer, http.StatusConflict, comm.ResponseData{
+			Err: conflict.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "subscribe topic success",
+	})
+}
+
+// 取消订阅 topic
+var UnsubscribeTopic http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept unsubscribe topic request")
+	defer request.Body.Close()
+	v := new(UnsubscribeTopicReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	err = TopicMap.Unsubscribe(v.Topic, v.Subscription)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "unsubscribe topic success",
+	})
+}
+
+// 发布消息到 topic
+var Publish http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept publish request")
+	defer request.Body.Close()
+	v := new(PublishReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	payload, err := newPayload(v.Msg, v.Body, v.ContentType, v.Headers)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	resp, err := TopicMap.Publish(request.Context(), v.Topic, payload)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	if resp.Delivered == 0 && len(resp.Failed) > 0 {
+		ServeJSON(writer, http.StatusInternalServerError, comm.ResponseData{
+			Err:  "failed to publish msg to any subscription",
+			Data: resp,
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "publish msg success",
+		Data: resp,
+	})
+}
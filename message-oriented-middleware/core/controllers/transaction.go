@@ -0,0 +1,333 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"technology/message-oriented-middleware/comm"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTxTimeout = 60 * time.Second
+	maxTxTimeout     = 10 * time.Minute
+)
+
+var TxMap = NewTransactions()
+
+// Transactions 保存进行中的事务。事务中暂存的消息只保存在内存中，提交前对消费者不可见，
+// broker 重启后未提交的事务全部丢弃
+type Transactions struct {
+	mutex sync.Mutex
+	txs   map[string]*transaction
+}
+
+// transaction 一个事务，提交后保留到超时，重复提交时返回相同的结果
+type transaction struct {
+	id        string
+	expireAt  time.Time
+	staged    []stagedMessage
+	committed bool
+}
+
+// stagedMessage 暂存的消息，提交时再构造消息，延迟投递与存活时间从提交时开始计算
+type stagedMessage struct {
+	id  string
+	req ProductReq
+}
+
+func NewTransactions() *Transactions {
+	return &Transactions{
+		txs: make(map[string]*transaction),
+	}
+}
+
+// Begin 开始一个事务，超过 timeout 未提交的事务自动放弃
+func (t *Transactions) Begin(timeout time.Duration) *transaction {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tx := &transaction{
+		id:       uuid.New().String(),
+		expireAt: time.Now().Add(timeout),
+	}
+	t.txs[tx.id] = tx
+	return tx
+}
+
+// get 返回未超时的事务，调用方需持有锁
+func (t *Transactions) get(txId string, now time.Time) (*transaction, error) {
+	tx, ok := t.txs[txId]
+	if !ok || now.After(tx.expireAt) {
+		return nil, fmt.Errorf("unknown or expired transaction %s", txId)
+	}
+	return tx, nil
+}
+
+// Put 在事务中暂存一条消息，返回消息 id
+func (t *Transactions) Put(txId string, req ProductReq) (string, error) {
+	now := time.Now()
+	dest, ok, err := productDest(req.DestName)
+	if !ok {
+		return "", fmt.Errorf("product msg to a unknown dest name %s", req.DestName)
+	}
+	if err != nil {
+		return "", err
+	}
+	if req.IdempotencyKey != "" || req.ProducerId != "" {
+		return "", fmt.Errorf("idempotency keys are not supported in transactions")
+	}
+	_, err = req.message(now, dest.Options())
+	if err != nil {
+		return "", err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tx, err := t.get(txId, now)
+	if err != nil {
+		return "", err
+	}
+	if tx.committed {
+		return "", fmt.Errorf("transaction %s has been committed", txId)
+	}
+	if len(tx.staged) >= maxBatchSize {
+		return "", fmt.Errorf("transaction %s can not contain more than %d messages", txId, maxBatchSize)
+	}
+	id := uuid.New().String()
+	tx.staged = append(tx.staged, stagedMessage{id: id, req: req})
+	return id, nil
+}
+
+// Commit 提交事务，所有 destination 的所有消费组都能容纳事务中的消息时才会写入，否则不写入任何消息。
+// 提交失败时事务保持打开，可以重试提交或放弃。队列已满时不会等待，OverflowBlock 与 OverflowDropNewest 策略
+// 都与 OverflowReject 相同，避免事务中的消息被部分丢弃
+func (t *Transactions) Commit(txId string) ([]string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	tx, err := t.get(txId, now)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(tx.staged))
+	for i, s := range tx.staged {
+		ids[i] = s.id
+	}
+	if tx.committed {
+		return ids, nil
+	}
+
+	var names []string
+	for _, s := range tx.staged {
+		if !contains(names, s.req.DestName) {
+			names = append(names, s.req.DestName)
+		}
+	}
+	// 按 destination 名称的顺序加锁，与单个 destination 内按消费组名称加锁的顺序一起保证不会死锁
+	sort.Strings(names)
+	dests := make(map[string]*Destination, len(names))
+	for _, name := range names {
+		dest, ok := DestinationMap.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("dest name %s has been deleted", name)
+		}
+		dests[name] = dest
+		dest.mutex.RLock()
+		defer dest.mutex.RUnlock()
+		unlock := dest.lockQueues()
+		defer unlock()
+	}
+
+	byDest := make(map[string][]message, len(names))
+	for _, s := range tx.staged {
+		dest := dests[s.req.DestName]
+		m, err := s.req.message(now, dest.opts)
+		if err != nil {
+			return nil, err
+		}
+		m.Id = s.id
+		dest.defaultExpireAt(&m, now)
+		dest.assignPartition(&m)
+		byDest[s.req.DestName] = append(byDest[s.req.DestName], m)
+	}
+	fulls := make(map[string]map[*Queue]bool, len(names))
+	for _, name := range names {
+		full, _, err := dests[name].checkPut(byDest[name], false)
+		if err != nil {
+			return nil, err
+		}
+		if len(full) > 0 && dests[name].opts.OverflowPolicy == OverflowDropNewest {
+			return nil, fmt.Errorf("queue of dest name %s has been full", name)
+		}
+		fulls[name] = full
+	}
+	// 先将所有消息写入预写日志，全部成功后再加入队列，任一写入失败时撤回已写入的消息
+	plans := make([]*putPlan, 0, len(names))
+	for _, name := range names {
+		plan, err := dests[name].preparePut(byDest[name], fulls[name])
+		if err != nil {
+			for _, prepared := range plans {
+				prepared.rollback()
+			}
+			logrus.WithField("txId", txId).WithField("destName", name).
+				Errorf("failed to write transaction to wal, roll back it, error = %v", err)
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	for _, plan := range plans {
+		plan.commit()
+	}
+	tx.committed = true
+	return ids, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Abort 放弃事务，丢弃其中暂存的消息
+func (t *Transactions) Abort(txId string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tx, err := t.get(txId, time.Now())
+	if err != nil {
+		return err
+	}
+	if tx.committed {
+		return fmt.Errorf("transaction %s has been committed", txId)
+	}
+	delete(t.txs, txId)
+	return nil
+}
+
+// expire 删除超时的事务，由后台巡检协程定期调用
+func (t *Transactions) expire(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, tx := range t.txs {
+		if now.After(tx.expireAt) {
+			if !tx.committed {
+				logrus.WithField("txId", id).Warnf("transaction timeout, abort it with %d staged messages", len(tx.staged))
+			}
+			delete(t.txs, id)
+		}
+	}
+}
+
+// BeginTx 开始事务
+var BeginTx http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept begin transaction request")
+	defer request.Body.Close()
+	v := new(BeginTxReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	timeout := defaultTxTimeout
+	if v.TimeoutSeconds > 0 {
+		timeout = time.Duration(v.TimeoutSeconds) * time.Second
+	}
+	if v.TimeoutSeconds < 0 || timeout > maxTxTimeout {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: fmt.Sprintf("timeoutSeconds must be in [0, %d]", int(maxTxTimeout.Seconds())),
+		})
+		return
+	}
+
+	tx := TxMap.Begin(timeout)
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "begin transaction success",
+		Data: BeginTxResp{TxId: tx.id, ExpireAt: tx.expireAt},
+	})
+}
+
+// TxPut 在事务中暂存消息
+var TxPut http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept transaction put request")
+	defer request.Body.Close()
+	v := new(TxPutReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	id, err := TxMap.Put(v.TxId, v.ProductReq)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "transaction put success",
+		Data: ProductResp{Id: id},
+	})
+}
+
+// CommitTx 提交事务
+var CommitTx http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept commit transaction request")
+	defer request.Body.Close()
+	v := new(TxReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	ids, err := TxMap.Commit(v.TxId)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg:  "commit transaction success",
+		Data: CommitTxResp{Ids: ids},
+	})
+}
+
+// AbortTx 放弃事务
+var AbortTx http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+	logrus.Infof("accept abort transaction request")
+	defer request.Body.Close()
+	v := new(TxReq)
+	err := json.NewDecoder(request.Body).Decode(v)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	err = TxMap.Abort(v.TxId)
+	if err != nil {
+		ServeJSON(writer, http.StatusBadRequest, comm.ResponseData{
+			Err: err.Error(),
+		})
+		return
+	}
+	ServeJSON(writer, http.StatusOK, comm.ResponseData{
+		Msg: "abort transaction success",
+	})
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"technology/message-oriented-middleware/core/wal"
+	"testing"
+	"time"
+)
+
+// withDataDir 在测试期间将消息持久化到临时目录，需要在创建 destination 之前调用
+func withDataDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := brokerOptions.DataDir
+	brokerOptions.DataDir = dir
+	t.Cleanup(func() {
+		brokerOptions.DataDir = saved
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// pendingRecords 返回 destination 默认消费组预写日志中尚未被确认的记录数
+func pendingRecords(t *testing.T, destName string) int {
+	log, records, err := wal.Open(partitionDir(destName, DefaultGroup, 0), wal.Options{})
+	if err != nil {
+		t.Fatalf("open wal of %s: %v", destName, err)
+	}
+	log.Close()
+	return len(records)
+}
+
+// stage 开始事务并暂存发往 destNames 的消息
+func stage(t *testing.T, destNames ...string) string {
+	tx := TxMap.Begin(time.Minute)
+	for _, name := range destNames {
+		if _, err := TxMap.Put(tx.id, ProductReq{DestName: name, Msg: "tx"}); err != nil {
+			t.Fatalf("stage message to %s: %v", name, err)
+		}
+	}
+	return tx.id
+}
+
+func TestCommitWritesAllDestinations(t *testing.T) {
+	withDataDir(t)
+	a, _ := register(t, "tx-ok-a", DestOptions{})
+	b, _ := register(t, "tx-ok-b", DestOptions{})
+	txId := stage(t, "tx-ok-a", "tx-ok-b", "tx-ok-b")
+	ids, err := TxMap.Commit(txId)
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("commit = %v, %v, want 3 ids", ids, err)
+	}
+	if n := queueSize(queueOf(t, a, DefaultGroup, 0)); n != 1 {
+		t.Errorf("messages in tx-ok-a = %d, want 1", n)
+	}
+	if n := queueSize(queueOf(t, b, DefaultGroup, 0)); n != 2 {
+		t.Errorf("messages in tx-ok-b = %d, want 2", n)
+	}
+
+	// 重复提交返回相同的结果，不会再次写入
+	again, err := TxMap.Commit(txId)
+	if err != nil || len(again) != 3 || again[0] != ids[0] {
+		t.Fatalf("second commit = %v, %v, want the same ids", again, err)
+	}
+	if n := queueSize(queueOf(t, b, DefaultGroup, 0)); n != 2 {
+		t.Errorf("messages in tx-ok-b after second commit = %d, want 2", n)
+	}
+}
+
+func TestCommitRollsBackOnWALFailure(t *testing.T) {
+	withDataDir(t)
+	a, _ := register(t, "tx-wal-a", DestOptions{})
+	b, _ := register(t, "tx-wal-b", DestOptions{})
+	// 按名称顺序先写入 tx-wal-a，再让 tx-wal-b 的预写日志写入失败
+	if err := queueOf(t, b, DefaultGroup, 0).log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	txId := stage(t, "tx-wal-a", "tx-wal-b")
+	if _, err := TxMap.Commit(txId); err == nil {
+		t.Fatal("commit with broken wal succeeded, want error")
+	}
+	if n := queueSize(queueOf(t, a, DefaultGroup, 0)); n != 0 {
+		t.Fatalf("messages visible in tx-wal-a after failed commit = %d, want 0", n)
+	}
+	// 已写入预写日志的消息被撤回，重启后也不会恢复
+	if n := pendingRecords(t, "tx-wal-a"); n != 0 {
+		t.Fatalf("pending wal records of tx-wal-a after failed commit = %d, want 0", n)
+	}
+	// 提交失败后事务保持打开，可以放弃
+	if err := TxMap.Abort(txId); err != nil {
+		t.Fatalf("abort after failed commit: %v", err)
+	}
+}
+
+func TestCommitRejectsDropNewestOverflow(t *testing.T) {
+	a, _ := register(t, "tx-full-a", DestOptions{})
+	full, _ := register(t, "tx-full-b", DestOptions{Capacity: 1, OverflowPolicy: OverflowDropNewest})
+	if _, err := full.Put(nil, textMessages("existing", 1)[0]); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	txId := stage(t, "tx-full-a", "tx-full-b")
+	if _, err := TxMap.Commit(txId); err == nil {
+		t.Fatal("commit into a full drop-newest queue succeeded, want error")
+	}
+	if n := queueSize(queueOf(t, a, DefaultGroup, 0)); n != 0 {
+		t.Fatalf("messages in tx-full-a after rejected commit = %d, want 0", n)
+	}
+	if n := queueSize(queueOf(t, full, DefaultGroup, 0)); n != 1 {
+		t.Fatalf("messages in tx-full-b after rejected commit = %d, want 1", n)
+	}
+}
@@ -1,26 +1,59 @@
 package main
 
 import (
+	"flag"
 	"net/http"
 	"technology/message-oriented-middleware/comm"
 	"technology/message-oriented-middleware/core/controllers"
+	"technology/message-oriented-middleware/core/wal"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	network = flag.String("network", "tcp", "listen network, tcp or unix")
+	addr    = flag.String("addr", ":8080", "listen address, or socket file path when network is unix")
+
+	dataDir       = flag.String("data-dir", "", "dir to persist messages, messages are kept in memory only when empty")
+	fsync         = flag.String("fsync", string(wal.SyncInterval), "wal fsync policy, always, interval or none")
+	fsyncInterval = flag.Duration("fsync-interval", 1*time.Second, "wal fsync interval when fsync policy is interval")
+
+	configFile = flag.String("config", "", "json config file of broker, e.g. destination templates")
+)
+
 func main() {
-	logrus.Infof("listening :8080")
-	l, err := comm.NewReliableListener("tcp", ":8080")
+	flag.Parse()
+	config := new(controllers.Config)
+	if *configFile != "" {
+		var err error
+		config, err = controllers.LoadConfig(*configFile)
+		if err != nil {
+			logrus.Fatalf("failed to load config, error = %v", err)
+			return
+		}
+	}
+	err := controllers.Init(controllers.Options{
+		DataDir: *dataDir,
+		WAL: wal.Options{
+			SyncPolicy:   wal.SyncPolicy(*fsync),
+			SyncInterval: *fsyncInterval,
+		},
+		Templates: config.Templates,
+	})
+	if err != nil {
+		logrus.Fatalf("failed to init broker, error = %v", err)
+		return
+	}
+
+	logrus.Infof("listening %s %s", *network, *addr)
+	l, err := comm.NewMixedListener(*network, *addr)
 	if err != nil {
-		logrus.Fatal("failed to listening 8080 port, error = %v", err)
+		logrus.Fatalf("failed to listening %s %s, error = %v", *network, *addr, err)
 		return
 	}
-	serverMux := http.NewServeMux()
-	serverMux.HandleFunc("/registry", controllers.Registry)
-	serverMux.HandleFunc("/consume", controllers.Consume)
-	serverMux.HandleFunc("/product", controllers.Product)
-	err = http.Serve(l, serverMux)
+	err = http.Serve(l, controllers.NewServeMux())
 	if err != nil {
-		logrus.Fatal("failed to serve http server, error = %v", err)
+		logrus.Fatalf("failed to serve http server, error = %v", err)
 	}
 }
@@ -0,0 +1,480 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SyncAlways 每条记录写入后都执行 fsync
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval 按固定间隔执行 fsync
+	SyncInterval SyncPolicy = "interval"
+	// SyncNone 不主动 fsync，由操作系统决定何时落盘
+	SyncNone SyncPolicy = "none"
+)
+
+const (
+	PutRecordType RecordType = iota + 1
+	AckRecordType
+	// UpdateRecordType 替换尚未被确认的 Put 记录的内容，Seq 为被替换的 Put 记录序号
+	UpdateRecordType
+)
+
+const (
+	recordHeaderLength = 4 + 4 + 1 + 8
+	segmentSuffix      = ".log"
+
+	defaultSegmentSize     = 64 * 1024 * 1024
+	defaultSyncInterval    = 1 * time.Second
+	defaultCompactInterval = 30 * time.Second
+)
+
+var (
+	logClosedError = fmt.Errorf("wal has been closed")
+)
+
+type SyncPolicy string
+
+type RecordType uint8
+
+// Options 预写日志的配置，零值字段使用默认值
+type Options struct {
+	SyncPolicy      SyncPolicy    `json:"syncPolicy,omitempty"`
+	SyncInterval    time.Duration `json:"syncInterval,omitempty"`
+	SegmentSize     int64         `json:"segmentSize,omitempty"`
+	CompactInterval time.Duration `json:"compactInterval,omitempty"`
+}
+
+func (o Options) withDefaults() Options {
+	if o.SyncPolicy == "" {
+		o.SyncPolicy = SyncInterval
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = defaultSyncInterval
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = defaultSegmentSize
+	}
+	if o.CompactInterval <= 0 {
+		o.CompactInterval = defaultCompactInterval
+	}
+	return o
+}
+
+// Validate ...
+func (o Options) Validate() error {
+	switch o.SyncPolicy {
+	case "", SyncAlways, SyncInterval, SyncNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown sync policy %s", o.SyncPolicy)
+	}
+}
+
+// Record 日志中的一条记录，Put 记录的 Seq 为分配的序号，Ack 与 Update 记录的 Seq 为对应的 Put 记录序号
+type Record struct {
+	Type RecordType
+	Seq  uint64
+	Data []byte
+}
+
+func (r Record) marshalBytes() []byte {
+	buf := make([]byte, recordHeaderLength+len(r.Data))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(r.Data)))
+	buf[8] = byte(r.Type)
+	binary.LittleEndian.PutUint64(buf[9:17], r.Seq)
+	copy(buf[recordHeaderLength:], r.Data)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// segment 日志分段，文件名为该分段第一条 Put 记录可能使用的序号
+type segment struct {
+	baseSeq uint64
+	path    string
+	size    int64
+	live    int
+}
+
+// Log 分段的追加写日志，记录队列中消息的写入与确认，
+// 所有 Put 记录都被确认的最旧分段会在后台被删除
+type Log struct {
+	mutex    sync.Mutex
+	dir      string
+	opts     Options
+	segments []*segment
+	file     *os.File
+	writer   *bufio.Writer
+	nextSeq  uint64
+	dirty    bool
+	isClose  bool
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Open 打开 dir 下的日志，返回尚未被确认的 Put 记录（按序号升序），被 Update 过的记录返回最后一次更新的内容
+func Open(dir string, opts Options) (*Log, []Record, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	l := &Log{
+		dir:    dir,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+	}
+	pending, err := l.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := l.openActive(); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.SyncPolicy == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	l.wg.Add(1)
+	go l.compactLoop()
+	return l, pending, nil
+}
+
+// replay 依次读取所有分段，重建每个分段的存活计数
+func (l *Log) replay() ([]Record, error) {
+	infos, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		baseSeq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{
+			baseSeq: baseSeq,
+			path:    filepath.Join(l.dir, name),
+			size:    info.Size(),
+		})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].baseSeq < l.segments[j].baseSeq
+	})
+
+	pending := make(map[uint64]Record)
+	for i, seg := range l.segments {
+		if seg.baseSeq > l.nextSeq {
+			l.nextSeq = seg.baseSeq
+		}
+		isLast := i == len(l.segments)-1
+		err := l.readSegment(seg, isLast, func(r Record) {
+			switch r.Type {
+			case PutRecordType:
+				pending[r.Seq] = r
+				seg.live++
+				if r.Seq >= l.nextSeq {
+					l.nextSeq = r.Seq + 1
+				}
+			case UpdateRecordType:
+				if put, ok := pending[r.Seq]; ok {
+					put.Data = r.Data
+					pending[r.Seq] = put
+				}
+			case AckRecordType:
+				if _, ok := pending[r.Seq]; ok {
+					delete(pending, r.Seq)
+					if owner := l.segmentOf(r.Seq); owner != nil {
+						owner.live--
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]Record, 0, len(pending))
+	for _, r := range pending {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	return records, nil
+}
+
+// readSegment 读取分段中的所有记录，最后一个分段末尾不完整或校验失败的记录会被截断
+func (l *Log) readSegment(seg *segment, isLast bool, fn func(r Record)) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, recordHeaderLength)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		}
+		var data []byte
+		if err == nil {
+			data = make([]byte, binary.LittleEndian.Uint32(header[4:8]))
+			_, err = io.ReadFull(reader, data)
+		}
+		if err == nil && crc32.ChecksumIEEE(append(header[4:recordHeaderLength:recordHeaderLength], data...)) !=
+			binary.LittleEndian.Uint32(header[0:4]) {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		if err != nil {
+			if !isLast {
+				return fmt.Errorf("corrupted segment %s at offset %d, error = %v", seg.path, offset, err)
+			}
+			logrus.WithField("segment", seg.path).WithField("offset", offset).
+				Warnf("truncate broken wal tail, error = %v", err)
+			seg.size = offset
+			return os.Truncate(seg.path, offset)
+		}
+
+		fn(Record{
+			Type: RecordType(header[8]),
+			Seq:  binary.LittleEndian.Uint64(header[9:17]),
+			Data: data,
+		})
+		offset += int64(recordHeaderLength + len(data))
+	}
+}
+
+// segmentOf 返回序号 seq 所在的分段
+func (l *Log) segmentOf(seq uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseSeq > seq
+	})
+	if i == 0 {
+		return nil
+	}
+	return l.segments[i-1]
+}
+
+// openActive 打开最后一个分段用于追加写，没有分段时创建新的分段
+func (l *Log) openActive() error {
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+	seg := l.segments[len(l.segments)-1]
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	return nil
+}
+
+// roll 关闭当前分段，并以下一个序号创建新的分段
+func (l *Log) roll() error {
+	if l.file != nil {
+		if err := l.flush(true); err != nil {
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+	seg := &segment{
+		baseSeq: l.nextSeq,
+		path:    filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.nextSeq, segmentSuffix)),
+	}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, seg)
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (l *Log) flush(sync bool) error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if sync && l.dirty {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		l.dirty = false
+	}
+	return nil
+}
+
+func (l *Log) write(r Record) error {
+	active := l.segments[len(l.segments)-1]
+	data := r.marshalBytes()
+	if _, err := l.writer.Write(data); err != nil {
+		return err
+	}
+	active.size += int64(len(data))
+	l.dirty = true
+	return l.flush(l.opts.SyncPolicy == SyncAlways)
+}
+
+// Append 写入一条 Put 记录，返回分配的序号
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.isClose {
+		return 0, logClosedError
+	}
+	// 只包含 Ack 记录的分段不切换，避免新分段与其使用相同的文件名
+	if active := l.segments[len(l.segments)-1]; active.size >= l.opts.SegmentSize && active.baseSeq < l.nextSeq {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+	seq := l.nextSeq
+	err := l.write(Record{Type: PutRecordType, Seq: seq, Data: data})
+	if err != nil {
+		return 0, err
+	}
+	l.nextSeq++
+	l.segments[len(l.segments)-1].live++
+	return seq, nil
+}
+
+// NextSeq 返回下一条 Put 记录将使用的序号
+func (l *Log) NextSeq() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.nextSeq
+}
+
+// Ack 写入一条 Ack 记录，确认序号为 seq 的消息已被消费
+func (l *Log) Ack(seq uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.isClose {
+		return logClosedError
+	}
+	err := l.write(Record{Type: AckRecordType, Seq: seq})
+	if err != nil {
+		return err
+	}
+	if owner := l.segmentOf(seq); owner != nil {
+		owner.live--
+	}
+	return nil
+}
+
+// Update 写入一条 Update 记录，重放时使用 data 替换序号为 seq 的 Put 记录的内容
+func (l *Log) Update(seq uint64, data []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.isClose {
+		return logClosedError
+	}
+	return l.write(Record{Type: UpdateRecordType, Seq: seq, Data: data})
+}
+
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			l.mutex.Lock()
+			if !l.isClose {
+				if err := l.flush(true); err != nil {
+					logrus.WithField("dir", l.dir).Errorf("failed to sync wal, error = %v", err)
+				}
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+func (l *Log) compactLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			if err := l.Compact(); err != nil {
+				logrus.WithField("dir", l.dir).Errorf("failed to compact wal, error = %v", err)
+			}
+		}
+	}
+}
+
+// Compact 从最旧的分段开始删除所有消息都已被确认的分段，当前写入的分段不会被删除。
+// 只删除连续的前缀分段，保证被删除分段中的 Ack 记录不会再被需要
+func (l *Log) Compact() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.isClose {
+		return nil
+	}
+	for len(l.segments) > 1 && l.segments[0].live <= 0 {
+		if err := os.Remove(l.segments[0].path); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Close 刷新并关闭日志
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	if l.isClose {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.isClose = true
+	close(l.stopCh)
+	err := l.flush(l.opts.SyncPolicy != SyncNone)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.mutex.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+// Remove 关闭日志并删除其所有数据
+func (l *Log) Remove() error {
+	if err := l.Close(); err != nil {
+		logrus.WithField("dir", l.dir).Errorf("failed to close wal before remove, error = %v", err)
+	}
+	return os.RemoveAll(l.dir)
+}
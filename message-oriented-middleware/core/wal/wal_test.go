@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func open(t *testing.T, dir string, opts Options) (*Log, []Record) {
+	l, records, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	return l, records
+}
+
+func appendAll(t *testing.T, l *Log, n int) []uint64 {
+	seqs := make([]uint64, n)
+	for i := range seqs {
+		seq, err := l.Append([]byte(fmt.Sprintf("msg-%d", i)))
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		seqs[i] = seq
+	}
+	return seqs
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestReplayOrder(t *testing.T) {
+	dir := tempDir(t)
+	l, records := open(t, dir, Options{SyncPolicy: SyncAlways})
+	if len(records) != 0 {
+		t.Fatalf("got %d records from empty wal, want 0", len(records))
+	}
+	seqs := appendAll(t, l, 5)
+	for i, seq := range seqs {
+		if seq != uint64(i) {
+			t.Fatalf("seq of record %d = %d, want %d", i, seq, i)
+		}
+	}
+	// 乱序确认部分消息，并更新一条尚未确认的消息
+	for _, seq := range []uint64{3, 0} {
+		if err := l.Ack(seq); err != nil {
+			t.Fatalf("ack %d: %v", seq, err)
+		}
+	}
+	if err := l.Update(2, []byte("updated")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	l, records = open(t, dir, Options{})
+	defer l.Close()
+	want := []Record{
+		{Type: PutRecordType, Seq: 1, Data: []byte("msg-1")},
+		{Type: PutRecordType, Seq: 2, Data: []byte("updated")},
+		{Type: PutRecordType, Seq: 4, Data: []byte("msg-4")},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d pending records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		if r.Type != want[i].Type || r.Seq != want[i].Seq || string(r.Data) != string(want[i].Data) {
+			t.Errorf("record %d = {%d %d %q}, want {%d %d %q}",
+				i, r.Type, r.Seq, r.Data, want[i].Type, want[i].Seq, want[i].Data)
+		}
+	}
+}
+
+func TestTruncateCorruptTail(t *testing.T) {
+	dir := tempDir(t)
+	l, _ := open(t, dir, Options{SyncPolicy: SyncAlways})
+	appendAll(t, l, 3)
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	files := segmentFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("got %d segments, want 1", len(files))
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 破坏最后一条记录的内容，使其校验失败
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, records := open(t, dir, Options{SyncPolicy: SyncAlways})
+	if len(records) != 2 || records[0].Seq != 0 || records[1].Seq != 1 {
+		t.Fatalf("got pending records %v, want seq 0 and 1", records)
+	}
+	// 被截断记录的序号会被重新分配
+	seq, err := l.Append([]byte("after truncate"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if seq != 2 {
+		t.Fatalf("seq after truncate = %d, want 2", seq)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	l, records = open(t, dir, Options{})
+	defer l.Close()
+	if len(records) != 3 || string(records[2].Data) != "after truncate" {
+		t.Fatalf("got pending records %v after reopen, want the record appended after truncate", records)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := tempDir(t)
+	// 每条记录都超过分段大小，每条 Put 记录写入一个新的分段
+	l, _ := open(t, dir, Options{SyncPolicy: SyncAlways, SegmentSize: 1})
+	defer l.Close()
+	seqs := appendAll(t, l, 4)
+	if n := len(segmentFiles(t, dir)); n != 4 {
+		t.Fatalf("got %d segments, want 4", n)
+	}
+
+	// 只确认第二个分段的消息，最旧的分段仍有存活的消息，不能删除任何分段
+	if err := l.Ack(seqs[1]); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if n := len(segmentFiles(t, dir)); n != 4 {
+		t.Fatalf("got %d segments after compact, want 4", n)
+	}
+
+	// 确认全部消息后删除除当前写入分段之外的所有分段
+	for _, seq := range []uint64{seqs[0], seqs[2], seqs[3]} {
+		if err := l.Ack(seq); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	files := segmentFiles(t, dir)
+	if len(files) != 1 || filepath.Base(files[0]) != fmt.Sprintf("%020d%s", seqs[3], segmentSuffix) {
+		t.Fatalf("got segments %v after compact, want only the active segment", files)
+	}
+}
+
+func TestNextSeqAfterReopen(t *testing.T) {
+	dir := tempDir(t)
+	l, _ := open(t, dir, Options{SyncPolicy: SyncAlways, SegmentSize: 1})
+	seqs := appendAll(t, l, 3)
+	// 确认所有消息并删除旧分段后，序号仍需从文件名与剩余记录中恢复
+	for _, seq := range seqs {
+		if err := l.Ack(seq); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	l, records := open(t, dir, Options{})
+	defer l.Close()
+	if len(records) != 0 {
+		t.Fatalf("got %d pending records, want 0", len(records))
+	}
+	if next := l.NextSeq(); next != 3 {
+		t.Fatalf("NextSeq after reopen = %d, want 3", next)
+	}
+	seq, err := l.Append([]byte("msg"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if seq != 3 {
+		t.Fatalf("seq after reopen = %d, want 3", seq)
+	}
+}
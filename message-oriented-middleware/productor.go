@@ -18,11 +18,11 @@ func main() {
 			DestName: "test1",
 			Msg:      msg,
 		}
-		err := c.Product(req)
+		productResp, err := c.ProductWithResp(req)
 		if err != nil {
 			logrus.WithField("req", req).Errorf("failed to product message, error = %v", err)
 		} else {
-			logrus.Infof("success product message %s", msg)
+			logrus.Infof("success product message %s, id = %s", msg, productResp.Id)
 		}
 		time.Sleep(1 * time.Second)
 	}